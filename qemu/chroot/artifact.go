@@ -1,15 +1,19 @@
 package chroot
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 )
 
 const BuilderId = "summerwind.qemu-chroot"
 
 type Artifact struct {
-	dir   string
-	files []string
+	dir          string
+	files        []string
+	manifest     *Manifest
+	manifestPath string
 }
 
 func (*Artifact) BuilderId() string {
@@ -25,13 +29,69 @@ func (a *Artifact) Id() string {
 }
 
 func (a *Artifact) String() string {
-	return fmt.Sprintf("Image files in directory: %s", a.dir)
+	if a.manifest == nil || len(a.manifest.Images) == 0 {
+		return fmt.Sprintf("Image files in directory: %s", a.dir)
+	}
+
+	image := a.manifest.Images[0]
+	return fmt.Sprintf("Image files in directory: %s (%s, virtual size: %d bytes, sha256: %s)", a.dir, image.Format, image.VirtualSize, image.SHA256)
 }
 
+// State returns the metadata of the artifact. The values are limited to
+// basic types so that they can be passed over RPC. Complex values are
+// encoded in JSON.
 func (a *Artifact) State(name string) interface{} {
+	if a.manifest == nil {
+		return nil
+	}
+
+	switch name {
+	case "manifest":
+		return a.manifestPath
+	case "source_checksum":
+		return a.manifest.SourceChecksum
+	case "source_checksum_type":
+		return a.manifest.SourceChecksumType
+	case "started_at":
+		return a.manifest.StartedAt.Format(time.RFC3339)
+	case "finished_at":
+		return a.manifest.FinishedAt.Format(time.RFC3339)
+	case "partitions":
+		return encodeState(a.manifest.Partitions)
+	case "images":
+		return encodeState(a.manifest.Images)
+	}
+
+	if len(a.manifest.Images) == 0 {
+		return nil
+	}
+
+	image := a.manifest.Images[0]
+	switch name {
+	case "format":
+		return image.Format
+	case "virtual_size":
+		return image.VirtualSize
+	case "size":
+		return image.Size
+	case "sha256":
+		return image.SHA256
+	case "sha512":
+		return image.SHA512
+	}
+
 	return nil
 }
 
 func (a *Artifact) Destroy() error {
 	return os.RemoveAll(a.dir)
 }
+
+func encodeState(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	return string(b)
+}
@@ -0,0 +1,187 @@
+package chroot
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const binfmtMiscPath = "/proc/sys/fs/binfmt_misc"
+
+// emulatedArch represents an architecture emulated by qemu-user-static.
+// The magic and mask are the ELF header patterns used by qemu-binfmt-conf.sh
+// and are written to binfmt_misc as they are.
+type emulatedArch struct {
+	Name   string
+	GOARCH string
+	Magic  string
+	Mask   string
+}
+
+var emulatedArchs = []emulatedArch{
+	{
+		Name:   "aarch64",
+		GOARCH: "arm64",
+		Magic:  `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`,
+		Mask:   `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	{
+		Name:   "arm",
+		GOARCH: "arm",
+		Magic:  `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`,
+		Mask:   `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	{
+		Name:   "ppc64le",
+		GOARCH: "ppc64le",
+		Magic:  `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x15\x00`,
+		Mask:   `\xff\xff\xff\xff\xff\xff\xff\xfc\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\x00`,
+	},
+	{
+		Name:   "s390x",
+		GOARCH: "s390x",
+		Magic:  `\x7fELF\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x16`,
+		Mask:   `\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`,
+	},
+	{
+		Name:   "riscv64",
+		GOARCH: "riscv64",
+		Magic:  `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`,
+		Mask:   `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	{
+		Name:   "x86_64",
+		GOARCH: "amd64",
+		Magic:  `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00`,
+		Mask:   `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	{
+		Name:   "i386",
+		GOARCH: "386",
+		Magic:  `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x03\x00`,
+		Mask:   `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+}
+
+// archAliases maps the architecture names used by distributions and Go to
+// the names used by QEMU.
+var archAliases = map[string]string{
+	"arm64":   "aarch64",
+	"armhf":   "arm",
+	"armv7":   "arm",
+	"armv7l":  "arm",
+	"ppc64el": "ppc64le",
+	"amd64":   "x86_64",
+	"386":     "i386",
+	"i686":    "i386",
+}
+
+// findEmulatedArch returns the architecture by its QEMU name or alias.
+func findEmulatedArch(name string) (emulatedArch, bool) {
+	if alias, ok := archAliases[name]; ok {
+		name = alias
+	}
+
+	for _, a := range emulatedArchs {
+		if a.Name == name {
+			return a, true
+		}
+	}
+
+	return emulatedArch{}, false
+}
+
+// isNative returns true if the architecture can be run on the host without
+// emulation.
+func (a emulatedArch) isNative() bool {
+	return a.GOARCH == runtime.GOARCH || (a.GOARCH == "386" && runtime.GOARCH == "amd64")
+}
+
+// handlerName returns the name of the binfmt_misc handler of the
+// architecture.
+func (a emulatedArch) handlerName() string {
+	return "qemu-" + a.Name
+}
+
+// binfmtHandler returns whether the binfmt_misc handler is registered and
+// enabled, and its interpreter path.
+func binfmtHandler(name string) (bool, string, error) {
+	f, err := os.Open(filepath.Join(binfmtMiscPath, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	defer f.Close()
+
+	enabled := false
+	interpreter := ""
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "enabled":
+			enabled = true
+		case strings.HasPrefix(line, "interpreter "):
+			interpreter = strings.TrimPrefix(line, "interpreter ")
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, "", err
+	}
+
+	return enabled, interpreter, nil
+}
+
+// registerBinfmtHandler registers the binfmt_misc handler of the
+// architecture with the interpreter. The handler is registered with the
+// fix-binary flag so that the interpreter is also available to the
+// processes within the chroot.
+func registerBinfmtHandler(arch emulatedArch, interpreter string, cmdWrapper CommandWrapper) error {
+	if _, err := os.Stat(filepath.Join(binfmtMiscPath, "register")); err != nil {
+		return fmt.Errorf("binfmt_misc is not mounted on %s", binfmtMiscPath)
+	}
+
+	rule := fmt.Sprintf(":%s:M::%s:%s:%s:F", arch.handlerName(), arch.Magic, arch.Mask, interpreter)
+
+	// The rule is written through stdin so that the command wrapper
+	// applies to the write.
+	cmd, err := cmdWrapper(fmt.Sprintf("tee %s", filepath.Join(binfmtMiscPath, "register")))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Binfmt command: %s", cmd)
+	log.Printf("Binfmt rule: %s", rule)
+
+	shell := NewShellCommand(cmd)
+	shell.Stdin = strings.NewReader(rule)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("%s\n%s", err, shell.Stderr)
+	}
+
+	return nil
+}
+
+// findInterpreter returns the path of the qemu-user-static binary of the
+// architecture on the host.
+func findInterpreter(arch emulatedArch) (string, error) {
+	name := fmt.Sprintf("qemu-%s-static", arch.Name)
+
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s is not found", name)
+	}
+
+	return p, nil
+}
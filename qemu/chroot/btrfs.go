@@ -0,0 +1,79 @@
+package chroot
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// btrfsRootSubvolumes is a list of subvolume names commonly used for the
+// root filesystem by distributions.
+var btrfsRootSubvolumes = []string{"@", "root", "@root"}
+
+// listBtrfsSubvolumes returns the paths of the subvolumes in the btrfs
+// filesystem mounted at mountPath.
+func listBtrfsSubvolumes(mountPath string, cmdWrapper CommandWrapper) ([]string, error) {
+	cmd, err := cmdWrapper(fmt.Sprintf("btrfs subvolume list %s", mountPath))
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	shell := NewShellCommand(cmd)
+	shell.Stdout = stdout
+	shell.Stderr = stderr
+	if err := shell.Run(); err != nil {
+		return nil, fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	subvolumes := []string{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		// e.g. "ID 256 gen 7 top level 5 path @"
+		i := strings.Index(line, " path ")
+		if i < 0 {
+			continue
+		}
+
+		subvolumes = append(subvolumes, strings.TrimSpace(line[i+len(" path "):]))
+	}
+
+	return subvolumes, nil
+}
+
+// findBtrfsRootSubvolume returns the subvolume containing the root
+// filesystem if the filesystem mounted at mountPath is not the root
+// filesystem itself. It returns an empty string if nothing is found.
+func findBtrfsRootSubvolume(mountPath string, cmdWrapper CommandWrapper) (string, error) {
+	if hasOSRelease(mountPath) {
+		return "", nil
+	}
+
+	subvolumes, err := listBtrfsSubvolumes(mountPath, cmdWrapper)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range btrfsRootSubvolumes {
+		for _, subvol := range subvolumes {
+			if subvol == name && hasOSRelease(filepath.Join(mountPath, subvol)) {
+				return subvol, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// hasOSRelease returns whether the directory contains os-release file.
+func hasOSRelease(dir string) bool {
+	for _, p := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if _, err := os.Lstat(filepath.Join(dir, p)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -4,8 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os/exec"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/helper/config"
@@ -18,19 +19,85 @@ import (
 type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 
-	SourceImage    string     `mapstructure:"source_image"`
-	OutputDir      string     `mapstructure:"output_directory"`
-	ImageName      string     `mapstructure:"image_name"`
-	Compression    bool       `mapstructure:"compression"`
-	DevicePath     string     `mapstructure:"device_path"`
-	MountPath      string     `mapstructure:"mount_path"`
-	MountPartition int        `mapstructure:"mount_partition"`
-	MountOptions   []string   `mapstructure:"mount_options"`
-	ChrootMounts   [][]string `mapstructure:"chroot_mounts"`
-	CopyFiles      []string   `mapstructure:"copy_files"`
-	CommandWrapper string     `mapstructure:"command_wrapper"`
-
-	ctx interpolate.Context
+	SourceImage         string               `mapstructure:"source_image"`
+	SourceChecksum      string               `mapstructure:"source_checksum"`
+	SourceChecksumType  string               `mapstructure:"source_checksum_type"`
+	SourceChecksumURL   string               `mapstructure:"source_checksum_url"`
+	SourceFormat        string               `mapstructure:"source_format"`
+	OutputDir           string               `mapstructure:"output_directory"`
+	ImageName           string               `mapstructure:"image_name"`
+	Compression         bool                 `mapstructure:"compression"`
+	OutputFormats       []OutputFormatConfig `mapstructure:"output_formats"`
+	Sparsify            bool                 `mapstructure:"sparsify"`
+	UseBackingFile      bool                 `mapstructure:"use_backing_file"`
+	KeepBackingFile     bool                 `mapstructure:"keep_backing_file"`
+	DeviceBackend       string               `mapstructure:"device_backend"`
+	DevicePath          string               `mapstructure:"device_path"`
+	NBDMaxPart          int                  `mapstructure:"nbd_max_part"`
+	NBDsMax             int                  `mapstructure:"nbds_max"`
+	RawDeviceTimeout    string               `mapstructure:"device_timeout"`
+	UdevSettle          bool                 `mapstructure:"udev_settle"`
+	Partprobe           bool                 `mapstructure:"partprobe"`
+	MountPath           string               `mapstructure:"mount_path"`
+	MountPartition      int                  `mapstructure:"mount_partition"`
+	RootPartitionLabel  string               `mapstructure:"root_partition_label"`
+	RootPartitionUUID   string               `mapstructure:"root_partition_uuid"`
+	RootPartitionFSType string               `mapstructure:"root_partition_fstype"`
+	DetectRootPartition bool                 `mapstructure:"detect_root_partition"`
+	ActivateLVM         bool                 `mapstructure:"activate_lvm"`
+	RootLogicalVolume   string               `mapstructure:"root_logical_volume"`
+	LUKSPassphrase      string               `mapstructure:"luks_passphrase"`
+	LUKSKeyFile         string               `mapstructure:"luks_key_file"`
+	MountOptions        []string             `mapstructure:"mount_options"`
+	PartitionMounts     map[string]string    `mapstructure:"partition_mounts"`
+	MountFstab          bool                 `mapstructure:"mount_fstab"`
+	BtrfsRootSubvolume  string               `mapstructure:"btrfs_root_subvolume"`
+	BtrfsSubvolumes     map[string]string    `mapstructure:"btrfs_subvolumes"`
+	ZFSPool             string               `mapstructure:"zfs_pool"`
+	ZFSRootDataset      string               `mapstructure:"zfs_root_dataset"`
+	ChrootMounts        [][]string           `mapstructure:"chroot_mounts"`
+	CopyFiles           []string             `mapstructure:"copy_files"`
+	PreventServiceStart bool                 `mapstructure:"prevent_service_start"`
+	UploadOwner         string               `mapstructure:"upload_owner"`
+	UploadGroup         string               `mapstructure:"upload_group"`
+	TargetArch          string               `mapstructure:"target_arch"`
+	CommandWrapper      string               `mapstructure:"command_wrapper"`
+	ExecutionMode       string               `mapstructure:"execution_mode"`
+	NspawnBoot          bool                 `mapstructure:"nspawn_boot"`
+	NspawnArgs          []string             `mapstructure:"nspawn_args"`
+	UnshareNetwork      bool                 `mapstructure:"unshare_network"`
+	RawBootTimeout      string               `mapstructure:"nspawn_boot_timeout"`
+	FromScratch         bool                 `mapstructure:"from_scratch"`
+	DiskSize            string               `mapstructure:"disk_size"`
+	PartitionTable      string               `mapstructure:"partition_table"`
+	Partitions          []PartitionConfig    `mapstructure:"partitions"`
+	PreMountCommands    []string             `mapstructure:"pre_mount_commands"`
+	PostMountCommands   []string             `mapstructure:"post_mount_commands"`
+
+	ctx           interpolate.Context
+	deviceTimeout time.Duration
+	bootTimeout   time.Duration
+}
+
+// OutputFormatConfig represents an additional image file converted from
+// the resulting image.
+type OutputFormatConfig struct {
+	Format          string `mapstructure:"format"`
+	Filename        string `mapstructure:"filename"`
+	Subformat       string `mapstructure:"subformat"`
+	Compat          string `mapstructure:"compat"`
+	ClusterSize     string `mapstructure:"cluster_size"`
+	Compression     bool   `mapstructure:"compression"`
+	CompressionType string `mapstructure:"compression_type"`
+}
+
+// PartitionConfig represents a partition created when building from scratch.
+type PartitionConfig struct {
+	Name       string `mapstructure:"name"`
+	Type       string `mapstructure:"type"`
+	Size       string `mapstructure:"size"`
+	Filesystem string `mapstructure:"filesystem"`
+	Label      string `mapstructure:"label"`
 }
 
 // Cleaner is an interface with a function for cleanup.
@@ -54,6 +121,15 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 	err := config.Decode(&b.config, &config.DecodeOpts{
 		Interpolate:        true,
 		InterpolateContext: &b.config.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			Exclude: []string{
+				"command_wrapper",
+				"mount_path",
+				"partition_mounts",
+				"pre_mount_commands",
+				"post_mount_commands",
+			},
+		},
 	}, raws...)
 	if err != nil {
 		return nil, err
@@ -71,15 +147,77 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 		b.config.MountPath = "/mnt/packer-builder-qemu-chroot/{{.Device}}"
 	}
 
-	if b.config.MountPartition == 0 {
+	if b.config.DeviceBackend == "" {
+		b.config.DeviceBackend = deviceBackendNBD
+	}
+
+	if b.config.NBDMaxPart == 0 {
+		b.config.NBDMaxPart = 16
+	}
+
+	if b.config.NBDsMax == 0 {
+		b.config.NBDsMax = 16
+	}
+
+	if b.config.RawDeviceTimeout == "" {
+		b.config.RawDeviceTimeout = "30s"
+	}
+
+	if b.config.FromScratch && b.config.PartitionTable == "" {
+		b.config.PartitionTable = "gpt"
+	}
+
+	// The root partition is resolved after the device is connected if
+	// any criteria is specified.
+	selectRoot := b.config.RootPartitionLabel != "" || b.config.RootPartitionUUID != "" ||
+		b.config.RootPartitionFSType != "" || b.config.DetectRootPartition
+
+	if b.config.FromScratch {
+		for i, p := range b.config.Partitions {
+			if p.Type == "" {
+				p.Type = "linux"
+			}
+
+			if p.Filesystem == "" {
+				p.Filesystem = defaultFilesystems[p.Type]
+			}
+
+			if p.Type == "root" && b.config.MountPartition == 0 && !selectRoot {
+				b.config.MountPartition = i + 1
+			}
+
+			b.config.Partitions[i] = p
+		}
+	}
+
+	if b.config.RootLogicalVolume != "" {
+		b.config.ActivateLVM = true
+	}
+
+	if b.config.MountPartition == 0 && !selectRoot {
 		b.config.MountPartition = 1
 	}
 
+	for i, f := range b.config.OutputFormats {
+		if f.Filename == "" && outputFormats[f.Format] != "" {
+			b.config.OutputFormats[i].Filename = fmt.Sprintf("%s.%s", b.config.ImageName, outputFormats[f.Format])
+		}
+	}
+
 	if b.config.ChrootMounts == nil {
 		b.config.ChrootMounts = make([][]string, 0)
 	}
 
-	if len(b.config.ChrootMounts) == 0 {
+	if b.config.ExecutionMode == "" {
+		b.config.ExecutionMode = executionModeChroot
+	}
+
+	if b.config.RawBootTimeout == "" {
+		b.config.RawBootTimeout = "1m"
+	}
+
+	// systemd-nspawn sets up /proc, /sys and /dev by itself.
+	if len(b.config.ChrootMounts) == 0 && b.config.ExecutionMode != executionModeNspawn {
 		b.config.ChrootMounts = [][]string{
 			{"proc", "proc", "/proc"},
 			{"sysfs", "sysfs", "/sys"},
@@ -105,8 +243,168 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 	var errs *packer.MultiError
 	var warns []string
 
-	if b.config.SourceImage == "" {
+	b.config.deviceTimeout, err = time.ParseDuration(b.config.RawDeviceTimeout)
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Failed to parse device_timeout: %s", err))
+	}
+
+	b.config.bootTimeout, err = time.ParseDuration(b.config.RawBootTimeout)
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Failed to parse nspawn_boot_timeout: %s", err))
+	}
+
+	switch b.config.ExecutionMode {
+	case executionModeChroot, executionModeNspawn, executionModeUnshare:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported execution_mode: %s", b.config.ExecutionMode))
+	}
+
+	if b.config.UnshareNetwork && b.config.ExecutionMode != executionModeUnshare {
+		errs = packer.MultiErrorAppend(errs, errors.New("unshare_network requires execution_mode to be unshare."))
+	}
+
+	if b.config.NspawnBoot && b.config.ExecutionMode != executionModeNspawn {
+		errs = packer.MultiErrorAppend(errs, errors.New("nspawn_boot requires execution_mode to be nspawn."))
+	}
+
+	if b.config.SourceFormat != "" {
+		valid := false
+		for _, f := range imageFormats {
+			if b.config.SourceFormat == f {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported source_format: %s", b.config.SourceFormat))
+		}
+	}
+
+	filenames := map[string]bool{b.config.ImageName: true}
+	for i, f := range b.config.OutputFormats {
+		if _, ok := outputFormats[f.Format]; !ok {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported format at output_formats[%d]: %s", i, f.Format))
+			continue
+		}
+
+		if filenames[f.Filename] {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Duplicated filename at output_formats[%d]: %s", i, f.Filename))
+		}
+		filenames[f.Filename] = true
+
+		if f.CompressionType != "" && f.CompressionType != "zlib" && f.CompressionType != "zstd" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported compression_type at output_formats[%d]: %s", i, f.CompressionType))
+		}
+
+		if (f.Compression || f.CompressionType != "") && f.Format != "qcow2" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Compression is only supported by qcow2 at output_formats[%d].", i))
+		}
+	}
+
+	if selectRoot && b.config.MountPartition != 0 {
+		errs = packer.MultiErrorAppend(errs, errors.New("mount_partition cannot be specified with root_partition_label, root_partition_uuid, root_partition_fstype or detect_root_partition."))
+	}
+
+	if b.config.LUKSPassphrase != "" && b.config.LUKSKeyFile != "" {
+		errs = packer.MultiErrorAppend(errs, errors.New("Only one of luks_passphrase or luks_key_file can be specified."))
+	}
+
+	if b.config.ZFSPool != "" && (b.config.BtrfsRootSubvolume != "" || len(b.config.BtrfsSubvolumes) > 0) {
+		errs = packer.MultiErrorAppend(errs, errors.New("zfs_pool cannot be specified with btrfs_root_subvolume or btrfs_subvolumes."))
+	}
+
+	if b.config.ZFSRootDataset != "" && !strings.HasPrefix(b.config.ZFSRootDataset, b.config.ZFSPool+"/") {
+		errs = packer.MultiErrorAppend(errs, errors.New("zfs_root_dataset must be a dataset in zfs_pool."))
+	}
+
+	if b.config.TargetArch != "" {
+		if _, ok := findEmulatedArch(b.config.TargetArch); !ok {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported target_arch: %s", b.config.TargetArch))
+		}
+	}
+
+	if _, err := NewDeviceBackend(b.config.DeviceBackend); err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid device_backend: %s", err))
+	}
+
+	if b.config.UseBackingFile && b.config.DeviceBackend == deviceBackendLoop {
+		errs = packer.MultiErrorAppend(errs, errors.New("use_backing_file is not supported by the loop device backend."))
+	}
+
+	if b.config.KeepBackingFile && !b.config.UseBackingFile {
+		errs = packer.MultiErrorAppend(errs, errors.New("keep_backing_file requires use_backing_file to be true."))
+	}
+
+	if !b.config.FromScratch && len(b.config.Partitions) > 0 {
+		warns = append(warns, "partitions is ignored when from_scratch is false.")
+	}
+
+	if b.config.FromScratch {
+		if b.config.SourceImage != "" {
+			warns = append(warns, "source_image is ignored when from_scratch is true.")
+		}
+
+		if b.config.DiskSize == "" {
+			errs = packer.MultiErrorAppend(errs, errors.New("disk_size is required with from_scratch."))
+		}
+
+		if len(b.config.Partitions) == 0 {
+			errs = packer.MultiErrorAppend(errs, errors.New("partitions is required with from_scratch."))
+		}
+
+		if b.config.PartitionTable != "gpt" && b.config.PartitionTable != "mbr" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported partition_table: %s", b.config.PartitionTable))
+		}
+
+		for i, p := range b.config.Partitions {
+			if _, ok := partitionTypes[p.Type]; !ok {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported partition type at partitions[%d]: %s", i, p.Type))
+			}
+
+			if p.Size == "" && i != len(b.config.Partitions)-1 {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("size is required except for the last partition at partitions[%d].", i))
+			}
+		}
+	} else if b.config.SourceImage == "" {
 		errs = packer.MultiErrorAppend(errs, errors.New("source_image is required."))
+	} else {
+		u, err := common.DownloadableURL(b.config.SourceImage)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Failed to parse source_image: %s", err))
+		} else {
+			b.config.SourceImage = u
+		}
+	}
+
+	if b.config.SourceChecksumType == "" {
+		if b.config.SourceChecksum == "" && b.config.SourceChecksumURL == "" {
+			b.config.SourceChecksumType = "none"
+		} else {
+			errs = packer.MultiErrorAppend(errs, errors.New("source_checksum_type is required when a checksum is specified."))
+		}
+	}
+
+	b.config.SourceChecksumType = strings.ToLower(b.config.SourceChecksumType)
+	b.config.SourceChecksum = strings.ToLower(b.config.SourceChecksum)
+
+	switch b.config.SourceChecksumType {
+	case "", "none":
+	case "md5", "sha1", "sha256", "sha512":
+		if b.config.SourceChecksum == "" && b.config.SourceChecksumURL == "" {
+			errs = packer.MultiErrorAppend(errs, errors.New("source_checksum or source_checksum_url is required."))
+		}
+
+		if b.config.SourceChecksum == "" && b.config.SourceChecksumURL != "" && b.config.SourceImage != "" {
+			checksum, err := fetchChecksum(b.config.SourceChecksumURL, b.config.SourceImage)
+			if err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error retrieving checksum from source_checksum_url: %s", err))
+			} else {
+				b.config.SourceChecksum = checksum
+			}
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported source_checksum_type: %s", b.config.SourceChecksumType))
 	}
 
 	if errs != nil && len(errs.Errors) > 0 {
@@ -122,29 +420,66 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 		return nil, errors.New("The amazon-chroot builder only works on Linux environments.")
 	}
 
-	_, err := exec.LookPath("qemu-nbd")
+	backend, err := NewDeviceBackend(b.config.DeviceBackend)
 	if err != nil {
-		return nil, errors.New("qemu-nbd command not found.")
+		return nil, err
+	}
+
+	if err := backend.Preflight(ui, &b.config, NewCommandWrapper(b.config)); err != nil {
+		return nil, err
 	}
 
 	state := new(multistep.BasicStateBag)
+	state.Put("started_at", time.Now().UTC())
 	state.Put("config", &b.config)
 	state.Put("hook", hook)
+	state.Put("cache", cache)
 	state.Put("ui", ui)
 	state.Put("command_wrapper", NewCommandWrapper(b.config))
+	state.Put("device_backend", backend)
 
 	steps := []multistep.Step{
 		&StepPrepareOutputDir{},
+	}
+
+	if !b.config.FromScratch {
+		steps = append(steps, &common.StepDownload{
+			Checksum:     b.config.SourceChecksum,
+			ChecksumType: b.config.SourceChecksumType,
+			Description:  "source image",
+			ResultKey:    "source_image_path",
+			Url:          []string{b.config.SourceImage},
+		})
+	}
+
+	steps = append(steps,
 		&StepPrepareImage{},
+		&StepResizeImage{},
 		&StepPrepareDevice{},
 		&StepConnectImage{},
+		&StepPartitionDevice{},
+		&StepResolvePartition{},
+		&StepGrowPartition{},
+		&StepOpenLUKS{},
+		&StepActivateVolumeGroups{},
+		&StepInspectPartitions{},
+		&StepPreMountCommands{},
 		&StepMountDevice{},
+		&StepGrowFilesystem{},
+		&StepMountPartitions{},
+		&StepSetupEmulation{},
+		&StepPostMountCommands{},
 		&StepMountExtra{},
 		&StepCopyFiles{},
+		&StepPreventServiceStart{},
+		&StepBootContainer{},
 		&StepChrootProvision{},
+		&StepSparsifyImage{},
 		&StepEarlyCleanup{},
 		&StepCompressImage{},
-	}
+		&StepConvertImage{},
+		&StepWriteManifest{},
+	)
 
 	b.runner = common.NewRunner(steps, b.config.PackerConfig, ui)
 	b.runner.Run(state)
@@ -161,11 +496,17 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 		return nil, errors.New("Build was halted.")
 	}
 
+	files := []string{state.Get("image_path").(string)}
+	files = append(files, state.Get("output_paths").([]string)...)
+	if backingFile, ok := state.GetOk("backing_file_path"); ok {
+		files = append(files, backingFile.(string))
+	}
+
 	artifact := &Artifact{
-		dir: b.config.OutputDir,
-		files: []string{
-			state.Get("image_path").(string),
-		},
+		dir:          b.config.OutputDir,
+		files:        files,
+		manifest:     state.Get("manifest").(*Manifest),
+		manifestPath: state.Get("manifest_path").(string),
 	}
 
 	return artifact, nil
@@ -0,0 +1,112 @@
+package chroot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/common"
+)
+
+// checksumTimeout is the timeout to retrieve a checksum file, which is done
+// while preparing the build.
+const checksumTimeout = 30 * time.Second
+
+// fetchChecksum retrieves a checksum file from checksumURL and returns
+// the checksum of the file referred by sourceURL.
+func fetchChecksum(checksumURL, sourceURL string) (string, error) {
+	checksumURL, err := common.DownloadableURL(checksumURL)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(checksumURL)
+	if err != nil {
+		return "", err
+	}
+
+	var r io.ReadCloser
+	switch u.Scheme {
+	case "http", "https":
+		client := &http.Client{Timeout: checksumTimeout}
+		res, err := client.Get(checksumURL)
+		if err != nil {
+			return "", err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return "", fmt.Errorf("unexpected status: %s", res.Status)
+		}
+
+		r = res.Body
+	case "file":
+		f, err := os.Open(filepath.FromSlash(u.Path))
+		if err != nil {
+			return "", err
+		}
+
+		r = f
+	default:
+		return "", fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	defer r.Close()
+
+	su, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", err
+	}
+
+	return parseChecksumFile(r, path.Base(su.Path))
+}
+
+// parseChecksumFile finds the checksum of filename from the content of
+// checksum file. Both GNU style ("<checksum>  <filename>") and BSD style
+// ("<type> (<filename>) = <checksum>") entries are supported.
+func parseChecksumFile(r io.Reader, filename string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// BSD style
+		if i := strings.Index(line, ") = "); i > 0 {
+			start := strings.Index(line, " (")
+			if start < 0 || start > i {
+				continue
+			}
+
+			if path.Base(line[start+2:i]) == filename {
+				return strings.ToLower(strings.TrimSpace(line[i+4:])), nil
+			}
+
+			continue
+		}
+
+		// GNU style
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		name := strings.TrimPrefix(fields[1], "*")
+		if path.Base(name) == filename {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("checksum of %s not found", filename)
+}
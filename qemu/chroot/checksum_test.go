@@ -0,0 +1,76 @@
+package chroot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testChecksumFile = `# comment
+d41d8cd98f00b204e9800998ecf8427e  other.img
+E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855 *images/disk.qcow2
+SHA256 (bsd.img) = 9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08
+`
+
+func TestParseChecksumFile(t *testing.T) {
+	cases := []struct {
+		filename string
+		checksum string
+		err      bool
+	}{
+		{"other.img", "d41d8cd98f00b204e9800998ecf8427e", false},
+		{"disk.qcow2", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", false},
+		{"bsd.img", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", false},
+		{"missing.img", "", true},
+	}
+
+	for _, c := range cases {
+		checksum, err := parseChecksumFile(strings.NewReader(testChecksumFile), c.filename)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error", c.filename)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.filename, err)
+			continue
+		}
+
+		if checksum != c.checksum {
+			t.Errorf("%s: expected %s, got %s", c.filename, c.checksum, checksum)
+		}
+	}
+}
+
+func TestFetchChecksum(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/SHA256SUMS":
+			fmt.Fprint(w, testChecksumFile)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	checksum, err := fetchChecksum(ts.URL+"/SHA256SUMS", ts.URL+"/images/bsd.img")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"; checksum != expected {
+		t.Errorf("expected %s, got %s", expected, checksum)
+	}
+
+	if _, err := fetchChecksum(ts.URL+"/SHA256SUMS", ts.URL+"/missing.img"); err == nil {
+		t.Error("expected error for missing entry")
+	}
+
+	if _, err := fetchChecksum(ts.URL+"/notfound", ts.URL+"/bsd.img"); err == nil {
+		t.Error("expected error for non-200 status")
+	}
+}
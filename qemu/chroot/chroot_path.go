@@ -0,0 +1,75 @@
+package chroot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is the maximum number of symlinks followed to resolve a path,
+// which is the same as the limit of Linux.
+const maxSymlinks = 40
+
+// chrootPath returns the host path of the path within the chroot at root.
+// Each component is resolved relative to root as the kernel does within
+// the chroot: absolute symlinks are resolved from root and ".." never goes
+// above root, so the returned path is always under root. Components which
+// do not exist are appended as they are.
+func chrootPath(root, path string) (string, error) {
+	root = filepath.Clean(root)
+
+	resolved := "/"
+	remaining := path
+	links := 0
+
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i == -1 {
+			part, remaining = remaining, ""
+		} else {
+			part, remaining = remaining[:i], remaining[i+1:]
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.New("too many levels of symbolic links")
+		}
+
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = link + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
@@ -0,0 +1,69 @@
+package chroot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChrootPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "chroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, p := range []string{"etc", "usr/lib"} {
+		if err := os.MkdirAll(filepath.Join(root, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"lib":       "usr/lib",
+		"abs":       "/etc",
+		"escape":    "../../..",
+		"usr/up":    "../../../etc",
+		"loop":      "loop",
+		"etc/hosts": "/etc/hostname",
+	}
+	for name, link := range links {
+		if err := os.Symlink(link, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/", "/"},
+		{"", "/"},
+		{"/etc/passwd", "/etc/passwd"},
+		{"etc/passwd", "/etc/passwd"},
+		{"/../../etc", "/etc"},
+		{"/lib/modules", "/usr/lib/modules"},
+		{"/abs/passwd", "/etc/passwd"},
+		{"/escape/etc", "/etc"},
+		{"/usr/up/passwd", "/etc/passwd"},
+		{"/missing/../etc", "/etc"},
+		{"/etc/hosts", "/etc/hostname"},
+	}
+
+	for _, c := range cases {
+		actual, err := chrootPath(root, c.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.path, err)
+			continue
+		}
+
+		if expected := filepath.Join(root, c.expected); actual != expected {
+			t.Errorf("%s: expected %s, got %s", c.path, expected, actual)
+		}
+	}
+
+	if _, err := chrootPath(root, "/loop/file"); err == nil {
+		t.Error("/loop/file: expected error")
+	}
+}
@@ -2,6 +2,7 @@ package chroot
 
 import (
 	"os/exec"
+	"strings"
 
 	"github.com/hashicorp/packer/template/interpolate"
 )
@@ -23,3 +24,44 @@ func NewCommandWrapper(config Config) CommandWrapper {
 func NewShellCommand(command string) *exec.Cmd {
 	return exec.Command("/bin/sh", "-c", command)
 }
+
+// NewWrappedCommand returns the command to run args. If the command
+// wrapper does not change commands, args are run directly. Otherwise they
+// are quoted so that the shell running the wrapped command passes them as
+// they are.
+func NewWrappedCommand(args []string, cmdWrapper CommandWrapper) (*exec.Cmd, error) {
+	if cmdWrapper.isIdentity() {
+		return exec.Command(args[0], args[1:]...), nil
+	}
+
+	cmd, err := cmdWrapper(shellJoin(args))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewShellCommand(cmd), nil
+}
+
+// isIdentity returns true if the command wrapper returns commands as they
+// are, such as the default "{{.Command}}".
+func (w CommandWrapper) isIdentity() bool {
+	const probe = "packer-builder-qemu-chroot"
+
+	cmd, err := w(probe)
+	return err == nil && cmd == probe
+}
+
+// shellQuote quotes the string as a single word of the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellJoin quotes each argument and joins them into a shell command.
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	return strings.Join(quoted, " ")
+}
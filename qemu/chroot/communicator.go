@@ -4,32 +4,99 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hashicorp/packer/packer"
 )
 
+// Execution modes of the commands within the chroot.
+const (
+	executionModeChroot  = "chroot"
+	executionModeNspawn  = "nspawn"
+	executionModeUnshare = "unshare"
+)
+
 // Communicator is a special communicator that works by executing
 // commands locally but within a chroot.
 type Communicator struct {
 	Chroot     string
 	CmdWrapper CommandWrapper
+
+	// ExecutionMode is how commands are run within the chroot. Machine is
+	// the name of the booted container if any.
+	ExecutionMode  string
+	Machine        string
+	NspawnArgs     []string
+	ChrootMounts   [][]string
+	UnshareNetwork bool
+
+	// Env is the environment variables set to the commands.
+	Env []string
+
+	// UploadOwner and UploadGroup are the owner of uploaded files, which
+	// are resolved within the chroot.
+	UploadOwner string
+	UploadGroup string
+}
+
+// command returns the arguments to run the command within the chroot
+// according to the execution mode. The command is passed as a single
+// argument so that only the shell within the chroot interprets it, and
+// the environment variables are passed to env within the chroot.
+func (c *Communicator) command(command string) []string {
+	shell := []string{"/bin/sh", "-c", command}
+	if len(c.Env) > 0 {
+		env := append([]string{"/usr/bin/env"}, c.Env...)
+		shell = append(env, shell...)
+	}
+
+	switch {
+	case c.ExecutionMode == executionModeNspawn && c.Machine != "":
+		args := []string{"systemd-run", "--quiet", "--pipe", "--wait", fmt.Sprintf("--machine=%s", c.Machine)}
+		return append(args, shell...)
+	case c.ExecutionMode == executionModeNspawn:
+		args := []string{"systemd-nspawn", "--quiet", "--as-pid2", "--register=no", fmt.Sprintf("--directory=%s", c.Chroot)}
+		args = append(args, c.NspawnArgs...)
+		return append(args, shell...)
+	case c.ExecutionMode == executionModeUnshare:
+		return c.unshareCommand(shell)
+	default:
+		return append([]string{"chroot", c.Chroot}, shell...)
+	}
+}
+
+// unshareCommand returns the arguments to run the shell arguments within
+// the chroot in new PID, mount and UTS namespaces. The chroot_mounts are
+// mounted in the mount namespace so that they are unmounted and the
+// remaining processes are killed when the command exits.
+func (c *Communicator) unshareCommand(shell []string) []string {
+	script := []string{"set -e"}
+	for _, mountInfo := range c.ChrootMounts {
+		p := filepath.Join(c.Chroot, mountInfo[2])
+		script = append(script, fmt.Sprintf("mkdir -p %s", shellQuote(p)), shellJoin(chrootMountArgs(mountInfo, p)))
+	}
+	script = append(script, "exec "+shellJoin(append([]string{"chroot", c.Chroot}, shell...)))
+
+	args := []string{"unshare", "--fork", "--kill-child", "--pid", "--mount", "--uts", "--propagation", "private"}
+	if c.UnshareNetwork {
+		args = append(args, "--net")
+	}
+
+	return append(args, "/bin/sh", "-c", strings.Join(script, "\n"))
 }
 
 func (c *Communicator) Start(rc *packer.RemoteCmd) error {
-	cmd := fmt.Sprintf("chroot %s /bin/sh -c \"%s\"", c.Chroot, rc.Command)
-	cmd, err := c.CmdWrapper(cmd)
+	localCmd, err := NewWrappedCommand(c.command(rc.Command), c.CmdWrapper)
 	if err != nil {
 		return err
 	}
 
-	localCmd := NewShellCommand(cmd)
 	localCmd.Stdin = rc.Stdin
 	localCmd.Stdout = rc.Stdout
 	localCmd.Stderr = rc.Stderr
@@ -60,70 +127,99 @@ func (c *Communicator) Start(rc *packer.RemoteCmd) error {
 }
 
 func (c *Communicator) Upload(dst string, r io.Reader, fi *os.FileInfo) error {
-	dst = filepath.Join(c.Chroot, dst)
+	// The file at dst is replaced rather than followed if it is a symlink.
+	dir, err := chrootPath(c.Chroot, filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+
+	dst = filepath.Join(dir, filepath.Base(dst))
 	log.Printf("Uploading to chroot dir: %s", dst)
 
-	tf, err := ioutil.TempFile("", "packer-builder-qemu-chroot")
-	if err != nil {
-		return fmt.Errorf("Error preparing shell script: %s", err)
+	attrs := newFileAttrs(0644)
+
+	// Keep the mode and the owner of the existing file unless they are
+	// specified.
+	if info, err := os.Lstat(dst); err == nil && info.Mode().IsRegular() {
+		attrs = fileAttrsOf(info)
+		attrs.ModTime = time.Time{}
 	}
-	defer os.Remove(tf.Name())
 
-	if _, err := io.Copy(tf, r); err != nil {
-		return err
+	if fi != nil && *fi != nil {
+		attrs.Mode = fileMode((*fi).Mode())
+		attrs.ModTime = (*fi).ModTime()
 	}
 
-	cmd, err := c.CmdWrapper(fmt.Sprintf("cp %s %s", tf.Name(), dst))
-	if err != nil {
-		return err
+	if c.UploadOwner != "" || c.UploadGroup != "" {
+		uid, gid, err := lookupOwner(c.Chroot, c.UploadOwner, c.UploadGroup)
+		if err != nil {
+			return err
+		}
+
+		if uid != -1 {
+			attrs.UID = uid
+		}
+		if gid != -1 {
+			attrs.GID = gid
+		}
 	}
 
-	return NewShellCommand(cmd).Run()
+	return writeFileTo(dst, r, attrs, c.CmdWrapper)
 }
 
 func (c *Communicator) UploadDir(dst string, src string, exclude []string) error {
-	// If src ends with a trailing "/", copy from "src/." so that
-	// directory contents (including hidden files) are copied, but the
-	// directory "src" is omitted.  BSD does this automatically when
-	// the source contains a trailing slash, but linux does not.
-	if src[len(src)-1] == '/' {
-		src = src + "."
-	}
+	// The destination paths are resolved within the chroot so that the
+	// symlinks in the image never lead to the host.
+	log.Printf("Uploading directory '%s' to '%s' in chroot dir: %s", src, dst, c.Chroot)
 
-	// TODO: remove any file copied if it appears in `exclude`
-	chrootDest := filepath.Join(c.Chroot, dst)
-	log.Printf("Uploading directory '%s' to '%s'", src, chrootDest)
+	return copyTree(src, dst, exclude, c.Chroot, c.CmdWrapper)
+}
 
-	cmd, err := c.CmdWrapper(fmt.Sprintf("cp -R '%s' %s", src, chrootDest))
+func (c *Communicator) DownloadDir(src string, dst string, exclude []string) error {
+	chrootSrc, err := chrootPath(c.Chroot, src)
 	if err != nil {
 		return err
 	}
 
-	stderr := new(bytes.Buffer)
-	shell := NewShellCommand(cmd)
-	shell.Env = append(shell.Env, "LANG=C")
-	shell.Env = append(shell.Env, os.Environ()...)
-	shell.Stderr = stderr
-	if err := shell.Run(); err == nil {
-		return err
+	// chrootPath drops the trailing "/" of src, which decides whether the
+	// directory itself is copied.
+	if strings.HasSuffix(src, "/") {
+		chrootSrc += "/"
 	}
 
-	if strings.Contains(stderr.String(), "No such file") {
-		// This just means that the directory was empty. Just ignore it.
-		return nil
-	}
+	log.Printf("Downloading directory '%s' to '%s'", chrootSrc, dst)
 
-	return err
-}
+	if !c.CmdWrapper.isIdentity() {
+		return copyTreeFrom(chrootSrc, dst, exclude, c.CmdWrapper)
+	}
 
-func (c *Communicator) DownloadDir(src string, dst string, exclude []string) error {
-	return fmt.Errorf("DownloadDir is not implemented for packer-builder-qemu-chroot")
+	return copyTree(chrootSrc, dst, exclude, "", c.CmdWrapper)
 }
 
 func (c *Communicator) Download(src string, w io.Writer) error {
-	src = filepath.Join(c.Chroot, src)
+	src, err := chrootPath(c.Chroot, src)
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Downloading from chroot dir: %s", src)
 
+	if !c.CmdWrapper.isIdentity() {
+		cmd, err := NewWrappedCommand([]string{"cat", "--", src}, c.CmdWrapper)
+		if err != nil {
+			return err
+		}
+
+		stderr := new(bytes.Buffer)
+		cmd.Stdout = w
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s\n%s", err, stderr)
+		}
+
+		return nil
+	}
+
 	f, err := os.Open(src)
 	if err != nil {
 		return err
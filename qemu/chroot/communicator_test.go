@@ -0,0 +1,179 @@
+package chroot
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// trickyCommands are the commands which break if they are interpreted by
+// a shell other than the one within the chroot.
+var trickyCommands = []string{
+	`echo "double quoted"`,
+	`echo 'single quoted'`,
+	`echo $HOME ${PATH}`,
+	"echo `uname -a`",
+	`printf 'a\nb\\c'`,
+	"echo first\necho second",
+	"echo a; echo b && false || true",
+	`echo '\'' "'" "\""`,
+}
+
+// shellArgs returns the arguments of the shell command parsed by the shell.
+func shellArgs(t *testing.T, command string) []string {
+	out, err := exec.Command("/bin/sh", "-c", "printf '%s\\0' "+command).Output()
+	if err != nil {
+		t.Fatalf("%s: %s", command, err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+}
+
+func TestCommunicatorCommand(t *testing.T) {
+	for _, command := range trickyCommands {
+		shell := []string{"/bin/sh", "-c", command}
+
+		cases := []struct {
+			comm     *Communicator
+			expected []string
+		}{
+			{
+				&Communicator{Chroot: "/mnt/chroot"},
+				append([]string{"chroot", "/mnt/chroot"}, shell...),
+			},
+			{
+				&Communicator{Chroot: "/mnt/chroot", ExecutionMode: executionModeChroot},
+				append([]string{"chroot", "/mnt/chroot"}, shell...),
+			},
+			{
+				&Communicator{Chroot: "/mnt/chroot", ExecutionMode: executionModeNspawn, NspawnArgs: []string{"--private-network"}},
+				append([]string{"systemd-nspawn", "--quiet", "--as-pid2", "--register=no", "--directory=/mnt/chroot", "--private-network"}, shell...),
+			},
+			{
+				&Communicator{Chroot: "/mnt/chroot", ExecutionMode: executionModeNspawn, Machine: "packer-nbd0"},
+				append([]string{"systemd-run", "--quiet", "--pipe", "--wait", "--machine=packer-nbd0"}, shell...),
+			},
+			{
+				&Communicator{Chroot: "/mnt/chroot", Env: []string{"SYSTEMD_OFFLINE=1", "A=b c"}},
+				append([]string{"chroot", "/mnt/chroot", "/usr/bin/env", "SYSTEMD_OFFLINE=1", "A=b c"}, shell...),
+			},
+		}
+
+		for _, c := range cases {
+			if actual := c.comm.command(command); !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("%q in %s mode: expected %#v, got %#v", command, c.comm.ExecutionMode, c.expected, actual)
+			}
+		}
+	}
+}
+
+func TestCommunicatorUnshareCommand(t *testing.T) {
+	for _, env := range [][]string{nil, {"SYSTEMD_OFFLINE=1"}} {
+		for _, command := range trickyCommands {
+			comm := &Communicator{
+				Chroot:         "/mnt/chroot dir",
+				ExecutionMode:  executionModeUnshare,
+				ChrootMounts:   [][]string{{"proc", "proc", "/proc"}, {"bind", "/dev", "/dev"}},
+				UnshareNetwork: true,
+				Env:            env,
+			}
+
+			args := comm.command(command)
+
+			prefix := []string{"unshare", "--fork", "--kill-child", "--pid", "--mount", "--uts", "--propagation", "private", "--net", "/bin/sh", "-c"}
+			if len(args) != len(prefix)+1 || !reflect.DeepEqual(args[:len(prefix)], prefix) {
+				t.Errorf("%q: unexpected arguments: %#v", command, args)
+				continue
+			}
+
+			// The script ends with exec of the command, which the shell must
+			// parse into the original arguments.
+			script := args[len(prefix)]
+			i := strings.Index(script, "\nexec ")
+			if !strings.HasPrefix(script, "set -e\n") || i == -1 {
+				t.Errorf("%q: unexpected script: %s", command, script)
+				continue
+			}
+
+			expected := []string{"chroot", "/mnt/chroot dir"}
+			if len(env) > 0 {
+				expected = append(append(expected, "/usr/bin/env"), env...)
+			}
+			expected = append(expected, "/bin/sh", "-c", command)
+
+			if actual := shellArgs(t, script[i+len("\nexec "):]); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%q: expected %#v, got %#v", command, expected, actual)
+			}
+		}
+	}
+}
+
+func TestNewWrappedCommand(t *testing.T) {
+	identity := NewCommandWrapper(Config{CommandWrapper: "{{.Command}}"})
+	sudo := NewCommandWrapper(Config{CommandWrapper: "sudo {{.Command}}"})
+
+	for _, command := range trickyCommands {
+		args := []string{"chroot", "/mnt/chroot", "/bin/sh", "-c", command}
+
+		cmd, err := NewWrappedCommand(args, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(cmd.Args, args) {
+			t.Errorf("%q with identity wrapper: expected %#v, got %#v", command, args, cmd.Args)
+		}
+
+		cmd, err = NewWrappedCommand(args, sudo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(cmd.Args) != 3 || cmd.Args[0] != "/bin/sh" || cmd.Args[1] != "-c" || !strings.HasPrefix(cmd.Args[2], "sudo ") {
+			t.Errorf("%q with sudo wrapper: unexpected arguments: %#v", command, cmd.Args)
+			continue
+		}
+
+		// The shell running the wrapped command passes the arguments to
+		// sudo as they are.
+		expected := append([]string{"sudo"}, args...)
+		if actual := shellArgs(t, cmd.Args[2]); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%q with sudo wrapper: expected %#v, got %#v", command, expected, actual)
+		}
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	for _, command := range trickyCommands {
+		args := []string{"/bin/sh", "-c", command, ""}
+		if actual := shellArgs(t, shellJoin(args)); !reflect.DeepEqual(actual, args) {
+			t.Errorf("%q: expected %#v, got %#v", command, args, actual)
+		}
+	}
+}
+
+func TestCommandWrapperIsIdentity(t *testing.T) {
+	cases := []struct {
+		wrapper  string
+		expected bool
+	}{
+		{"{{.Command}}", true},
+		{"sudo {{.Command}}", false},
+		{"{{.Command}} ", false},
+		{"sh -c {{.Command}}", false},
+	}
+
+	for _, c := range cases {
+		if actual := NewCommandWrapper(Config{CommandWrapper: c.wrapper}).isIdentity(); actual != c.expected {
+			t.Errorf("%q: expected %v, got %v", c.wrapper, c.expected, actual)
+		}
+	}
+
+	failing := CommandWrapper(func(string) (string, error) {
+		return "", exec.ErrNotFound
+	})
+	if failing.isIdentity() {
+		t.Error("failing wrapper: expected false, got true")
+	}
+}
@@ -0,0 +1,357 @@
+package chroot
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// identityWrapper runs the file operations natively.
+var identityWrapper = CommandWrapper(func(command string) (string, error) {
+	return command, nil
+})
+
+// copyTree copies the directory tree of src into dst. If src ends with a
+// trailing "/", the contents of src are copied into dst. Otherwise the
+// directory src itself is copied into dst, as other communicators do.
+// Files whose path relative to src or base name matches any of exclude
+// patterns are skipped. Modes, symlinks and modification times are
+// preserved. If dstRoot is not empty, dst is a path within the chroot at
+// dstRoot and the destination paths are resolved with chrootPath, so that
+// symlinks in the chroot never lead to the host. src is read natively, and
+// dst is written with the command wrapper unless it is the identity.
+func copyTree(src, dst string, exclude []string, dstRoot string, cmdWrapper CommandWrapper) error {
+	if strings.HasSuffix(src, "/") {
+		// The trailing "/" also resolves src if it is a symlink.
+		resolved, err := filepath.EvalSymlinks(src)
+		if err != nil {
+			return err
+		}
+		src = resolved
+	} else {
+		src = filepath.Clean(src)
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+
+	// destPath returns the destination path of rel. The last component is
+	// resolved only if follow is true, so that a symlink at the destination
+	// of a file is replaced rather than followed.
+	destPath := func(rel string, follow bool) (string, error) {
+		if dstRoot == "" {
+			return filepath.Join(dst, rel), nil
+		}
+
+		if follow {
+			return chrootPath(dstRoot, filepath.Join(dst, rel))
+		}
+
+		dir, err := chrootPath(dstRoot, filepath.Join(dst, filepath.Dir(rel)))
+		if err != nil {
+			return "", err
+		}
+
+		return filepath.Join(dir, filepath.Base(rel)), nil
+	}
+
+	type dirTime struct {
+		path    string
+		modTime time.Time
+	}
+
+	// Timestamps of directories are set after their contents are copied
+	// since copying the contents updates them.
+	dirs := []dirTime{}
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if rel != "." && excluded(rel, exclude) {
+			log.Printf("Excluding: %s", path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target, err := destPath(rel, info.IsDir())
+		if err != nil {
+			return err
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := makeDirAll(target, cmdWrapper); err != nil {
+				return err
+			}
+			if err := changeMode(target, fileMode(mode), cmdWrapper); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTime{target, info.ModTime()})
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := removeNonDir(target, cmdWrapper); err != nil {
+				return err
+			}
+			if err := makeSymlink(link, target, cmdWrapper); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(path, target, info, cmdWrapper); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping special file: %s", path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := changeModTime(dirs[i].path, dirs[i].modTime, cmdWrapper); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyTreeFrom copies the directory tree of src into dst as copyTree does,
+// but src is read with tar run by the command wrapper so that the files
+// which only the wrapper can read are copied. dst is written natively.
+func copyTreeFrom(src, dst string, exclude []string, cmdWrapper CommandWrapper) error {
+	// tar stores the paths relative to dir, which start with base.
+	dir, base := filepath.Clean(src), "."
+	if !strings.HasSuffix(src, "/") {
+		dir, base = filepath.Split(dir)
+		dst = filepath.Join(dst, base)
+	}
+
+	cmd, err := NewWrappedCommand([]string{"tar", "-C", dir, "--hard-dereference", "-cf", "-", "--", base}, cmdWrapper)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("File command: %s %#v", cmd.Path, cmd.Args)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = extractTree(tar.NewReader(stdout), base, dst, exclude)
+
+	// Drain the rest so that tar exits if extracting fails halfway.
+	io.Copy(ioutil.Discard, stdout)
+	if werr := cmd.Wait(); werr != nil && err == nil {
+		err = fmt.Errorf("%s\n%s", werr, stderr)
+	}
+
+	return err
+}
+
+// extractTree extracts the tar archive of the tree at base into dst,
+// skipping the excluded files.
+func extractTree(tr *tar.Reader, base, dst string, exclude []string) error {
+	type dirTime struct {
+		path    string
+		modTime time.Time
+	}
+
+	dirs := []dirTime{}
+	skipped := []string{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(base, filepath.Clean(hdr.Name))
+		if err != nil {
+			return err
+		}
+
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+
+		if isUnder(rel, skipped) {
+			continue
+		}
+
+		info := hdr.FileInfo()
+
+		if rel != "." && excluded(rel, exclude) {
+			log.Printf("Excluding: %s", hdr.Name)
+			if info.IsDir() {
+				skipped = append(skipped, rel)
+			}
+			continue
+		}
+
+		target := filepath.Join(dst, rel)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, fileMode(info.Mode())); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTime{target, hdr.ModTime})
+		case tar.TypeSymlink:
+			if err := removeNonDir(target, identityWrapper); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			attrs := newFileAttrs(fileMode(info.Mode()))
+			attrs.ModTime = hdr.ModTime
+
+			if err := replaceFile(target, tr, attrs); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping special file: %s", hdr.Name)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isUnder returns true if the relative path is any of dirs or under them.
+func isUnder(rel string, dirs []string) bool {
+	for _, d := range dirs {
+		if rel == d || strings.HasPrefix(rel, d+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyFile copies the regular file src to dst with the mode and the
+// modification time of info.
+func copyFile(src, dst string, info os.FileInfo, cmdWrapper CommandWrapper) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if !cmdWrapper.isIdentity() {
+		attrs := newFileAttrs(fileMode(info.Mode()))
+		attrs.ModTime = info.ModTime()
+
+		return writeFileTo(dst, in, attrs, cmdWrapper)
+	}
+
+	// Remove the destination first so that a symlink at the destination
+	// is never followed.
+	if err := removeNonDir(dst, cmdWrapper); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dst, fileMode(info.Mode())); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// removeNonDir removes the file at path unless it is a directory.
+func removeNonDir(path string, cmdWrapper CommandWrapper) error {
+	// rm fails on a directory without -r.
+	if !cmdWrapper.isIdentity() {
+		return runWrappedFileCommand([]string{"rm", "-f", path}, cmdWrapper)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+
+	return os.Remove(path)
+}
+
+// fileMode returns the permission bits of mode including setuid, setgid
+// and sticky bits.
+func fileMode(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// excluded returns true if the relative path or its base name matches any
+// of the glob patterns.
+func excluded(rel string, patterns []string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, p := range patterns {
+		p = strings.TrimSuffix(filepath.ToSlash(p), "/")
+		if ok, _ := filepath.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,209 @@
+package chroot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeTree creates the files in dir.
+func writeTree(t *testing.T, dir string, files []string) {
+	for _, f := range files {
+		p := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listTree returns the paths of the files and the symlinks in dir.
+func listTree(t *testing.T, dir string) []string {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(files)
+	return files
+}
+
+func TestCopyTree(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "copy-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	writeTree(t, src, []string{"a.txt", "debug.log", "sub/b.txt", "sub/c.log", ".git/config"})
+	if err := os.Chmod(filepath.Join(src, ".git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		src      string
+		exclude  []string
+		expected []string
+	}{
+		{
+			src:      "src",
+			expected: []string{"src/.git/config", "src/a.txt", "src/debug.log", "src/sub/b.txt", "src/sub/c.log"},
+		},
+		{
+			src:      "src/",
+			expected: []string{".git/config", "a.txt", "debug.log", "sub/b.txt", "sub/c.log"},
+		},
+		{
+			src:      "src/",
+			exclude:  []string{"*.log", ".git/"},
+			expected: []string{"a.txt", "sub/b.txt"},
+		},
+		{
+			src:      "src",
+			exclude:  []string{"sub"},
+			expected: []string{"src/.git/config", "src/a.txt", "src/debug.log"},
+		},
+		{
+			src:      "src/",
+			exclude:  []string{"sub/*.txt"},
+			expected: []string{".git/config", "a.txt", "debug.log", "sub/c.log"},
+		},
+	}
+
+	copiers := map[string]func(src, dst string, exclude []string) error{
+		"native": func(src, dst string, exclude []string) error {
+			return copyTree(src, dst, exclude, "", testWrappers["identity"])
+		},
+		"wrapped": func(src, dst string, exclude []string) error {
+			return copyTree(src, dst, exclude, "", testWrappers["env"])
+		},
+		"tar": func(src, dst string, exclude []string) error {
+			return copyTreeFrom(src, dst, exclude, testWrappers["env"])
+		},
+	}
+
+	for name, copier := range copiers {
+		for i, c := range cases {
+			dst := filepath.Join(tmp, "dst", name, strconv.Itoa(i))
+
+			// filepath.Join would drop the trailing "/".
+			if err := copier(tmp+"/"+c.src, dst, c.exclude); err != nil {
+				t.Errorf("%s %s %v: unexpected error: %s", name, c.src, c.exclude, err)
+				continue
+			}
+
+			if actual := listTree(t, dst); !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("%s %s %v: expected %v, got %v", name, c.src, c.exclude, c.expected, actual)
+			}
+
+			// The mode of the directory is preserved.
+			if git := c.expected[0]; strings.HasSuffix(git, ".git/config") {
+				info, err := os.Stat(filepath.Join(dst, filepath.Dir(git)))
+				if err != nil || info.Mode().Perm() != 0700 {
+					t.Errorf("%s %s %v: unexpected mode of .git: %v, %v", name, c.src, c.exclude, info, err)
+				}
+			}
+		}
+	}
+}
+
+func TestCopyTreeChroot(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "copy-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	writeTree(t, src, []string{"a.txt", "sub/b.txt"})
+
+	// The symlinks in the chroot point to the host paths if followed on
+	// the host.
+	host := filepath.Join(tmp, "host")
+	writeTree(t, host, []string{"a.txt"})
+
+	root := filepath.Join(tmp, "root")
+	if err := os.MkdirAll(filepath.Join(root, "dst"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(host, filepath.Join(root, "dst", "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(host, "a.txt"), filepath.Join(root, "dst", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/dst", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmdWrapper := range testWrappers {
+		if err := copyTree(src+"/", "/link", nil, root, cmdWrapper); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if expected, actual := []string{"a.txt"}, listTree(t, host); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("host: expected %v, got %v", expected, actual)
+	}
+
+	if content, err := ioutil.ReadFile(filepath.Join(host, "a.txt")); err != nil || string(content) != "a.txt" {
+		t.Errorf("host file is modified: %q, %v", content, err)
+	}
+
+	// The symlink to the file is replaced, and the symlink to the
+	// directory is resolved within the chroot.
+	expected := []string{"dst/a.txt", "dst/sub", "link", strings.TrimPrefix(host, "/") + "/b.txt"}
+	sort.Strings(expected)
+
+	if actual := listTree(t, root); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("chroot: expected %v, got %v", expected, actual)
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	cases := []struct {
+		rel      string
+		patterns []string
+		expected bool
+	}{
+		{"a.txt", nil, false},
+		{"a.txt", []string{"*.txt"}, true},
+		{"sub/a.txt", []string{"*.txt"}, true},
+		{"sub/a.txt", []string{"sub/*.txt"}, true},
+		{"sub/a.txt", []string{"other/*.txt"}, false},
+		{"sub", []string{"sub/"}, true},
+		{".git", []string{".git"}, true},
+		{"sub/.git", []string{".git"}, true},
+		{"a.log", []string{"*.txt", "*.log"}, true},
+		{"a.txt.bak", []string{"*.txt"}, false},
+	}
+
+	for _, c := range cases {
+		if actual := excluded(c.rel, c.patterns); actual != c.expected {
+			t.Errorf("%s %v: expected %v, got %v", c.rel, c.patterns, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package chroot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const sectorSize = 512
+
+const devicePollInterval = 100 * time.Millisecond
+
+// sysClassBlock is the directory of block devices in sysfs.
+var sysClassBlock = "/sys/class/block"
+
+type partitionInfo struct {
+	Number     int    `json:"number"`
+	Device     string `json:"device"`
+	Start      int64  `json:"start"`
+	Size       int64  `json:"size"`
+	Filesystem string `json:"filesystem,omitempty"`
+	Label      string `json:"label,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	PartLabel  string `json:"partlabel,omitempty"`
+	PartUUID   string `json:"partuuid,omitempty"`
+}
+
+// listPartitions returns the partitions of the device with the attributes
+// probed by blkid.
+func listPartitions(device string, cmdWrapper CommandWrapper) ([]partitionInfo, error) {
+	name := filepath.Base(device)
+	sysPath := filepath.Join("/sys/block", name)
+
+	entries, err := ioutil.ReadDir(sysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := []partitionInfo{}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), name+"p") {
+			continue
+		}
+
+		num, err := strconv.Atoi(strings.TrimPrefix(e.Name(), name+"p"))
+		if err != nil {
+			continue
+		}
+
+		start, err := readSysInt(filepath.Join(sysPath, e.Name(), "start"))
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := readSysInt(filepath.Join(sysPath, e.Name(), "size"))
+		if err != nil {
+			return nil, err
+		}
+
+		p := partitionInfo{
+			Number: num,
+			Device: fmt.Sprintf("%sp%d", device, num),
+			Start:  start * sectorSize,
+			Size:   size * sectorSize,
+		}
+
+		attrs, err := blkid(p.Device, cmdWrapper)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Filesystem = attrs["TYPE"]
+		p.Label = attrs["LABEL"]
+		p.UUID = attrs["UUID"]
+		p.PartLabel = attrs["PARTLABEL"]
+		p.PartUUID = attrs["PARTUUID"]
+
+		partitions = append(partitions, p)
+	}
+
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].Number < partitions[j].Number
+	})
+
+	return partitions, nil
+}
+
+// blkid returns the attributes of the block device probed by blkid.
+func blkid(device string, cmdWrapper CommandWrapper) (map[string]string, error) {
+	cmd, err := cmdWrapper(fmt.Sprintf("blkid -p -o export %s", device))
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	shell := NewShellCommand(cmd)
+	shell.Stdout = stdout
+	shell.Stderr = stderr
+	if err := shell.Run(); err != nil {
+		// blkid exits with 2 if nothing was detected on the device.
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 2 {
+				return map[string]string{}, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	attrs := map[string]string{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) == 2 {
+			attrs[kv[0]] = kv[1]
+		}
+	}
+
+	return attrs, nil
+}
+
+func readSysInt(path string) (int64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// waitForDeviceSize waits until the device has a non-zero size, which means
+// the image is connected to the device.
+func waitForDeviceSize(device string, timeout time.Duration) error {
+	sizePath := filepath.Join("/sys/block", filepath.Base(device), "size")
+
+	return waitFor(timeout, func() bool {
+		size, err := readSysInt(sizePath)
+		return err == nil && size > 0
+	})
+}
+
+// waitForPartitions waits until the device nodes of the partitions appear.
+func waitForPartitions(device string, partitions []int, timeout time.Duration) error {
+	return waitFor(timeout, func() bool {
+		for _, num := range partitions {
+			if _, err := os.Stat(fmt.Sprintf("%sp%d", device, num)); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitForAnyPartitions waits until the device has at least one partition
+// and the device nodes of all partitions appear.
+func waitForAnyPartitions(device string, timeout time.Duration) error {
+	name := filepath.Base(device)
+
+	return waitFor(timeout, func() bool {
+		paths, err := filepath.Glob(filepath.Join("/sys/block", name, name+"p*"))
+		if err != nil || len(paths) == 0 {
+			return false
+		}
+
+		for _, p := range paths {
+			if _, err := os.Stat(filepath.Join("/dev", filepath.Base(p))); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func waitFor(timeout time.Duration, ready func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if ready() {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout after %s", timeout)
+		}
+
+		time.Sleep(devicePollInterval)
+	}
+}
+
+// settleDevice re-reads the partition table of the device and waits for
+// udev to process the events, as configured.
+func settleDevice(device string, config *Config, cmdWrapper CommandWrapper) error {
+	cmds := []string{}
+	if config.Partprobe {
+		cmds = append(cmds, fmt.Sprintf("partprobe %s", device))
+	}
+	if config.UdevSettle {
+		cmds = append(cmds, fmt.Sprintf("udevadm settle --timeout=%d", int(config.deviceTimeout.Seconds())))
+	}
+
+	for _, c := range cmds {
+		cmd, err := cmdWrapper(c)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Settle command: %s", cmd)
+
+		shell := NewShellCommand(cmd)
+		shell.Stderr = new(bytes.Buffer)
+		if err := shell.Run(); err != nil {
+			return fmt.Errorf("%s\n%s", err, shell.Stderr)
+		}
+	}
+
+	return nil
+}
+
+// isDeviceOf returns true if the block device source is the device, one of
+// its partitions, or a device mapper device such as an LVM logical volume
+// or a LUKS device stacked on them.
+func isDeviceOf(source, device string) bool {
+	if resolved, err := filepath.EvalSymlinks(source); err == nil {
+		source = resolved
+	}
+
+	return isBlockDeviceOf(filepath.Base(source), filepath.Base(device), 0)
+}
+
+func isBlockDeviceOf(name, device string, depth int) bool {
+	if name == device || strings.HasPrefix(name, device+"p") {
+		return true
+	}
+
+	// Guard against unexpected loops in sysfs.
+	if depth > 8 {
+		return false
+	}
+
+	slaves, err := ioutil.ReadDir(filepath.Join(sysClassBlock, name, "slaves"))
+	if err != nil {
+		return false
+	}
+
+	for _, slave := range slaves {
+		if isBlockDeviceOf(slave.Name(), device, depth+1) {
+			return true
+		}
+	}
+
+	return false
+}
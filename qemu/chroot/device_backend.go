@@ -0,0 +1,38 @@
+package chroot
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// Device backends.
+const (
+	deviceBackendNBD  = "nbd"
+	deviceBackendLoop = "loop"
+)
+
+// DeviceBackend attaches an image file to a block device of the host.
+type DeviceBackend interface {
+	// Preflight checks that the backend is usable on the host.
+	Preflight(ui packer.Ui, config *Config, cmdWrapper CommandWrapper) error
+
+	// Attach attaches the image to a block device and returns its path.
+	Attach(state multistep.StateBag) (string, error)
+
+	// Detach detaches the image from the block device.
+	Detach(state multistep.StateBag, device string) error
+}
+
+// NewDeviceBackend returns the DeviceBackend of given name.
+func NewDeviceBackend(name string) (DeviceBackend, error) {
+	switch name {
+	case deviceBackendNBD:
+		return new(nbdBackend), nil
+	case deviceBackendLoop:
+		return new(loopBackend), nil
+	}
+
+	return nil, fmt.Errorf("unsupported device backend: %s", name)
+}
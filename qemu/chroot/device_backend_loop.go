@@ -0,0 +1,129 @@
+package chroot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// loopBackend attaches the image to a loop device using losetup. Since
+// loop devices only support raw images, the image is converted to raw
+// format while it is attached and converted back when it is detached.
+type loopBackend struct {
+	rawPath string
+}
+
+func (b *loopBackend) Preflight(ui packer.Ui, config *Config, cmdWrapper CommandWrapper) error {
+	if _, err := exec.LookPath("losetup"); err != nil {
+		return errors.New("losetup command not found.")
+	}
+
+	return nil
+}
+
+func (b *loopBackend) Attach(state multistep.StateBag) (string, error) {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	imagePath := state.Get("image_path").(string)
+	imageFormat := state.Get("image_format").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	rawPath := imagePath
+	if imageFormat != "raw" {
+		rawPath = imagePath + ".raw"
+
+		ui.Message("Converting image to raw format...")
+		if err := runConvert(imageFormat, "raw", imagePath, rawPath, cmdWrapper); err != nil {
+			return "", fmt.Errorf("Error converting image to raw format: %s", err)
+		}
+
+		b.rawPath = rawPath
+	}
+
+	target := "--find"
+	if config.DevicePath != "" {
+		target = config.DevicePath
+	}
+
+	cmd, err := cmdWrapper(fmt.Sprintf("losetup --show --partscan %s %s", target, rawPath))
+	if err != nil {
+		return "", fmt.Errorf("Error creating losetup command: %s", err)
+	}
+
+	log.Printf("Losetup command: %s", cmd)
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	shell := NewShellCommand(cmd)
+	shell.Stdout = stdout
+	shell.Stderr = stderr
+	if err := shell.Run(); err != nil {
+		return "", fmt.Errorf("Error attaching image to loop device: %s\n%s", err, stderr)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (b *loopBackend) Detach(state multistep.StateBag, device string) error {
+	ui := state.Get("ui").(packer.Ui)
+	imagePath := state.Get("image_path").(string)
+	imageFormat := state.Get("image_format").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	cmd, err := cmdWrapper(fmt.Sprintf("losetup -d %s", device))
+	if err != nil {
+		return fmt.Errorf("Error creating losetup command: %s", err)
+	}
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("Error detaching image from loop device: %s\n%s", err, shell.Stderr)
+	}
+
+	if b.rawPath == "" {
+		return nil
+	}
+
+	// The raw image is no longer needed if the build has failed.
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if !cancelled && !halted {
+		ui.Message(fmt.Sprintf("Converting image back to %s format...", imageFormat))
+		if err := runConvert("raw", imageFormat, b.rawPath, imagePath, cmdWrapper); err != nil {
+			return fmt.Errorf("Error converting image to %s format: %s", imageFormat, err)
+		}
+	}
+
+	if err := os.Remove(b.rawPath); err != nil {
+		return fmt.Errorf("Error removing raw image: %s", err)
+	}
+
+	b.rawPath = ""
+
+	return nil
+}
+
+func runConvert(srcFormat, dstFormat, src, dst string, cmdWrapper CommandWrapper) error {
+	cmd, err := cmdWrapper(fmt.Sprintf("qemu-img convert -f %s -O %s %s %s", srcFormat, dstFormat, src, dst))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Conversion command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("%s\n%s", err, shell.Stderr)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package chroot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+const maxConnectAttempts = 3
+
+// nbdBackend attaches the image to a network block device using qemu-nbd.
+type nbdBackend struct{}
+
+func (b *nbdBackend) Preflight(ui packer.Ui, config *Config, cmdWrapper CommandWrapper) error {
+	if _, err := exec.LookPath("qemu-nbd"); err != nil {
+		return errors.New("qemu-nbd command not found.")
+	}
+
+	if _, err := os.Stat("/sys/module/nbd"); os.IsNotExist(err) {
+		ui.Say("Loading nbd kernel module...")
+		if err := loadNBDModule(config, cmdWrapper); err != nil {
+			return fmt.Errorf("The nbd kernel module is not loaded and could not be loaded: %s\n"+
+				"Run 'modprobe nbd max_part=%d nbds_max=%d' as root before building, "+
+				"or set command_wrapper to run commands with sudo.", err, config.NBDMaxPart, config.NBDsMax)
+		}
+	}
+
+	maxPart, err := readSysInt("/sys/module/nbd/parameters/max_part")
+	if err == nil && maxPart == 0 {
+		return errors.New("The nbd kernel module is loaded with max_part=0, so the partitions of the image cannot be detected.\n" +
+			"Reload the module with 'modprobe -r nbd && modprobe nbd max_part=16' as root before building.")
+	}
+
+	log.Println("Waiting for network block devices to appear")
+	err = waitFor(config.deviceTimeout, func() bool {
+		_, err := os.Stat(fmt.Sprintf("/dev/%s0", devicePrefix))
+		return err == nil
+	})
+	if err != nil {
+		return fmt.Errorf("Network block devices did not appear: %s", err)
+	}
+
+	return nil
+}
+
+// loadNBDModule loads the nbd kernel module with the configured parameters.
+func loadNBDModule(config *Config, cmdWrapper CommandWrapper) error {
+	cmd, err := cmdWrapper(fmt.Sprintf("modprobe nbd max_part=%d nbds_max=%d", config.NBDMaxPart, config.NBDsMax))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Modprobe command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("%s\n%s", err, shell.Stderr)
+	}
+
+	return nil
+}
+
+func (b *nbdBackend) Attach(state multistep.StateBag) (string, error) {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+
+	for attempt := 1; ; attempt++ {
+		err := b.connect(state, device)
+		if err == nil {
+			break
+		}
+
+		// Another process may have taken the device after it was found
+		// available, so retry with another device.
+		if config.DevicePath != "" || attempt >= maxConnectAttempts {
+			return "", err
+		}
+
+		log.Printf("Error connecting to device %s: %s", device, err)
+
+		allocator := state.Get("device_allocator").(*StepPrepareDevice)
+		device, err = allocator.Reallocate(state)
+		if err != nil {
+			return "", fmt.Errorf("Error finding available device: %s", err)
+		}
+
+		ui.Message(fmt.Sprintf("Retrying with device: %s", device))
+	}
+
+	return device, nil
+}
+
+func (b *nbdBackend) connect(state multistep.StateBag, device string) error {
+	config := state.Get("config").(*Config)
+	imagePath := state.Get("image_path").(string)
+	imageFormat := state.Get("image_format").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	opts := ""
+	if config.Sparsify {
+		// Pass discard requests through to the image to release unused clusters.
+		opts = " --discard=unmap --detect-zeroes=unmap"
+	}
+
+	cmd, err := cmdWrapper(fmt.Sprintf("qemu-nbd -c %s --format=%s%s %s", device, imageFormat, opts, imagePath))
+	if err != nil {
+		return fmt.Errorf("Error creating connect command: %s", err)
+	}
+
+	log.Printf("Connect command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("Error connecting to the source image: %s\n%s", err, shell.Stderr)
+	}
+
+	return nil
+}
+
+func (b *nbdBackend) Detach(state multistep.StateBag, device string) error {
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	cmd, err := cmdWrapper(fmt.Sprintf("qemu-nbd -d %s", device))
+	if err != nil {
+		return fmt.Errorf("Error creating disconnect command: %s", err)
+	}
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("Error disconnecting from source image: %s\n%s", err, shell.Stderr)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package chroot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const lockDir = "/var/lock"
+
+// deviceLock is an advisory lock on a device shared by all builds on the
+// host, which prevents concurrent builds from using the same device.
+type deviceLock struct {
+	file *os.File
+}
+
+// lockDevice acquires the lock for the device without blocking. It
+// returns an error if the lock is held by another process.
+func lockDevice(devicePath string) (*deviceLock, error) {
+	path := filepath.Join(lockDir, fmt.Sprintf("packer-builder-qemu-chroot.%s.lock", filepath.Base(devicePath)))
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &deviceLock{file: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *deviceLock) Unlock() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+
+	return l.file.Close()
+}
@@ -0,0 +1,47 @@
+package chroot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsDeviceOf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// dm-1 (LUKS) on dm-0 (LVM) on nbd0p2, and dm-2 on a host disk.
+	for _, p := range []string{"dm-0/slaves/nbd0p2", "dm-1/slaves/dm-0", "dm-2/slaves/sda1"} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orig := sysClassBlock
+	sysClassBlock = dir
+	defer func() { sysClassBlock = orig }()
+
+	cases := []struct {
+		source   string
+		expected bool
+	}{
+		{"/dev/nbd0", true},
+		{"/dev/nbd0p1", true},
+		{"/dev/nbd1p1", false},
+		{"/dev/nbd10p1", false},
+		{"/dev/dm-0", true},
+		{"/dev/dm-1", true},
+		{"/dev/dm-2", false},
+		{"/dev/sda1", false},
+	}
+
+	for _, c := range cases {
+		if actual := isDeviceOf(c.source, "/dev/nbd0"); actual != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.source, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package chroot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The file operations below are done natively when the command wrapper
+// does not change commands. Otherwise they are done with the wrapped
+// commands since the wrapper may be required to escalate privileges.
+
+// fileAttrs is the attributes of the file to write. UID and GID are -1 to
+// leave them unchanged, and ModTime is zero to leave it unchanged.
+type fileAttrs struct {
+	Mode    os.FileMode
+	UID     int
+	GID     int
+	ModTime time.Time
+}
+
+// newFileAttrs returns the attributes with mode and the owner and the
+// modification time unchanged.
+func newFileAttrs(mode os.FileMode) fileAttrs {
+	return fileAttrs{Mode: mode, UID: -1, GID: -1}
+}
+
+// fileAttrsOf returns the attributes of the file info.
+func fileAttrsOf(info os.FileInfo) fileAttrs {
+	attrs := newFileAttrs(fileMode(info.Mode()))
+	attrs.ModTime = info.ModTime()
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		attrs.UID = int(st.Uid)
+		attrs.GID = int(st.Gid)
+	}
+
+	return attrs
+}
+
+// copyFileTo copies the file src to dst with its mode and ownership. The
+// destination is replaced atomically, and a symlink at the destination is
+// replaced rather than followed.
+func copyFileTo(src, dst string, cmdWrapper CommandWrapper) error {
+	if !cmdWrapper.isIdentity() {
+		return runWrappedFileCommand([]string{"cp", "--remove-destination", "--preserve=mode,ownership", src, dst}, cmdWrapper)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	attrs := fileAttrsOf(info)
+	attrs.ModTime = time.Time{}
+
+	return replaceFile(dst, in, attrs)
+}
+
+// writeFileScript writes stdin to a temporary file next to $1, applies
+// the owner $2 unless empty, the mode $3 and the modification time $4
+// unless empty to it, and renames it to $1.
+const writeFileScript = `set -e
+tmp=$(mktemp "$(dirname "$1")/.$(basename "$1").packerXXXXXX")
+trap 'rm -f "$tmp"' EXIT
+cat > "$tmp"
+if [ -n "$2" ]; then chown "$2" "$tmp"; fi
+chmod "$3" "$tmp"
+if [ -n "$4" ]; then touch -m -d "$4" "$tmp"; fi
+mv -f -T "$tmp" "$1"
+`
+
+// writeFileTo streams the content of r to dst and applies attrs. The
+// content is written to a temporary file next to dst which replaces dst
+// atomically, natively or with the wrapped commands.
+func writeFileTo(dst string, r io.Reader, attrs fileAttrs, cmdWrapper CommandWrapper) error {
+	if cmdWrapper.isIdentity() {
+		return replaceFile(dst, r, attrs)
+	}
+
+	// chown clears the setuid and setgid bits, so chmod follows it.
+	owner := ""
+	if attrs.UID != -1 {
+		owner = strconv.Itoa(attrs.UID)
+	}
+	if attrs.GID != -1 {
+		owner += ":" + strconv.Itoa(attrs.GID)
+	}
+
+	mode := fmt.Sprintf("%04o", unixMode(attrs.Mode))
+
+	stamp := ""
+	if t := attrs.ModTime; !t.IsZero() {
+		stamp = fmt.Sprintf("@%d.%09d", t.Unix(), t.Nanosecond())
+	}
+
+	cmd, err := NewWrappedCommand([]string{"/bin/sh", "-c", writeFileScript, "sh", dst, owner, mode, stamp}, cmdWrapper)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("File command: %s %#v", cmd.Path, cmd.Args)
+
+	stderr := new(bytes.Buffer)
+	cmd.Stdin = r
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	return nil
+}
+
+// replaceFile writes the content of r to a temporary file next to dst,
+// applies attrs to it and renames it to dst.
+func replaceFile(dst string, r io.Reader, attrs fileAttrs) error {
+	tf, err := ioutil.TempFile(filepath.Dir(dst), fmt.Sprintf(".%s.packer", filepath.Base(dst)))
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is left only if renaming it fails.
+	tmp := tf.Name()
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(tf, r)
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if attrs.UID != -1 || attrs.GID != -1 {
+		if err := os.Lchown(tmp, attrs.UID, attrs.GID); err != nil {
+			return err
+		}
+	}
+
+	// Chmod after chown since chown clears the setuid and setgid bits.
+	if err := os.Chmod(tmp, attrs.Mode); err != nil {
+		return err
+	}
+
+	if !attrs.ModTime.IsZero() {
+		if err := os.Chtimes(tmp, attrs.ModTime, attrs.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// unixMode returns the permission bits of mode as used by chmod command.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+
+	return m
+}
+
+// fileExists returns true if the file at path exists. A symlink is not
+// followed.
+func fileExists(path string, cmdWrapper CommandWrapper) (bool, error) {
+	if cmdWrapper.isIdentity() {
+		if _, err := os.Lstat(path); err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	cmd, err := NewWrappedCommand([]string{"/bin/sh", "-c", `test -e "$1" || test -L "$1"`, "sh", path}, cmdWrapper)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("File command: %s %#v", cmd.Path, cmd.Args)
+
+	// test fails silently if the file does not exist, while the wrapper
+	// reports its own failure.
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok && stderr.Len() == 0 {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	return true, nil
+}
+
+// makeDirAll creates the directory at path with its parents.
+func makeDirAll(path string, cmdWrapper CommandWrapper) error {
+	if !cmdWrapper.isIdentity() {
+		return runWrappedFileCommand([]string{"mkdir", "-p", path}, cmdWrapper)
+	}
+
+	return os.MkdirAll(path, 0755)
+}
+
+// changeMode changes the mode of the file at path.
+func changeMode(path string, mode os.FileMode, cmdWrapper CommandWrapper) error {
+	if !cmdWrapper.isIdentity() {
+		return runWrappedFileCommand([]string{"chmod", fmt.Sprintf("%04o", unixMode(mode)), path}, cmdWrapper)
+	}
+
+	return os.Chmod(path, mode)
+}
+
+// changeModTime changes the access and modification times of the file at
+// path to t.
+func changeModTime(path string, t time.Time, cmdWrapper CommandWrapper) error {
+	if !cmdWrapper.isIdentity() {
+		stamp := fmt.Sprintf("@%d.%09d", t.Unix(), t.Nanosecond())
+		return runWrappedFileCommand([]string{"touch", "-d", stamp, path}, cmdWrapper)
+	}
+
+	return os.Chtimes(path, t, t)
+}
+
+// makeSymlink creates the symlink at path which points to link.
+func makeSymlink(link, path string, cmdWrapper CommandWrapper) error {
+	if !cmdWrapper.isIdentity() {
+		return runWrappedFileCommand([]string{"ln", "-s", "--", link, path}, cmdWrapper)
+	}
+
+	return os.Symlink(link, path)
+}
+
+// removeFile removes the file at path if it exists.
+func removeFile(path string, cmdWrapper CommandWrapper) error {
+	if !cmdWrapper.isIdentity() {
+		return runWrappedFileCommand([]string{"rm", "-f", path}, cmdWrapper)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// removeDir removes the empty directory at path.
+func removeDir(path string, cmdWrapper CommandWrapper) error {
+	if !cmdWrapper.isIdentity() {
+		return runWrappedFileCommand([]string{"rmdir", path}, cmdWrapper)
+	}
+
+	return os.Remove(path)
+}
+
+// renameFile renames the file src to dst.
+func renameFile(src, dst string, cmdWrapper CommandWrapper) error {
+	if !cmdWrapper.isIdentity() {
+		return runWrappedFileCommand([]string{"mv", "-f", src, dst}, cmdWrapper)
+	}
+
+	return os.Rename(src, dst)
+}
+
+// runWrappedFileCommand runs the file command with the command wrapper.
+func runWrappedFileCommand(args []string, cmdWrapper CommandWrapper) error {
+	cmd, err := NewWrappedCommand(args, cmdWrapper)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("File command: %s %#v", cmd.Path, cmd.Args)
+
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	return nil
+}
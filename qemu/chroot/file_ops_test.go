@@ -0,0 +1,159 @@
+package chroot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWrappers are the identity wrapper, which runs the file operations
+// natively, and a wrapper which runs them with the wrapped commands.
+var testWrappers = map[string]CommandWrapper{
+	"identity": NewCommandWrapper(Config{CommandWrapper: "{{.Command}}"}),
+	"env":      NewCommandWrapper(Config{CommandWrapper: "env {{.Command}}"}),
+}
+
+func TestFileExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(dir, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		expected bool
+	}{
+		{"file", true},
+		{"dangling", true},
+		{"missing", false},
+		{"with space", false},
+	}
+
+	for wrapperName, cmdWrapper := range testWrappers {
+		for _, c := range cases {
+			actual, err := fileExists(filepath.Join(dir, c.name), cmdWrapper)
+			if err != nil {
+				t.Errorf("%s with %s wrapper: unexpected error: %s", c.name, wrapperName, err)
+				continue
+			}
+
+			if actual != c.expected {
+				t.Errorf("%s with %s wrapper: expected %v, got %v", c.name, wrapperName, c.expected, actual)
+			}
+		}
+	}
+
+	failing := NewCommandWrapper(Config{CommandWrapper: "false {{.Command}}; echo failed >&2; false"})
+	if _, err := fileExists(filepath.Join(dir, "file"), failing); err == nil {
+		t.Error("failing wrapper: expected error")
+	}
+}
+
+func TestMakeDirAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for wrapperName, cmdWrapper := range testWrappers {
+		p := filepath.Join(dir, wrapperName, "a b", "c")
+		if err := makeDirAll(p, cmdWrapper); err != nil {
+			t.Fatalf("%s wrapper: %s", wrapperName, err)
+		}
+
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			t.Errorf("%s wrapper: directory is not created: %v", wrapperName, err)
+		}
+
+		// Existing directories are not an error.
+		if err := makeDirAll(p, cmdWrapper); err != nil {
+			t.Errorf("%s wrapper: %s", wrapperName, err)
+		}
+
+		if err := removeDir(p, cmdWrapper); err != nil {
+			t.Errorf("%s wrapper: %s", wrapperName, err)
+		}
+
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("%s wrapper: directory is not removed: %v", wrapperName, err)
+		}
+	}
+}
+
+func TestWriteFileTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(target, []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for wrapperName, cmdWrapper := range testWrappers {
+		sub := filepath.Join(dir, wrapperName)
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		// A symlink at the destination is replaced rather than followed.
+		dst := filepath.Join(sub, "file name")
+		if err := os.Symlink(target, dst); err != nil {
+			t.Fatal(err)
+		}
+
+		attrs := newFileAttrs(0750)
+		attrs.UID = os.Getuid()
+		attrs.ModTime = modTime
+
+		if err := writeFileTo(dst, strings.NewReader("content"), attrs, cmdWrapper); err != nil {
+			t.Fatalf("%s wrapper: %s", wrapperName, err)
+		}
+
+		info, err := os.Lstat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.Mode().IsRegular() || info.Mode().Perm() != 0750 {
+			t.Errorf("%s wrapper: unexpected mode: %s", wrapperName, info.Mode())
+		}
+
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%s wrapper: unexpected modification time: %s", wrapperName, info.ModTime())
+		}
+
+		if content, err := ioutil.ReadFile(dst); err != nil || string(content) != "content" {
+			t.Errorf("%s wrapper: unexpected content: %q, %v", wrapperName, content, err)
+		}
+
+		// No temporary file is left.
+		if files, err := ioutil.ReadDir(sub); err != nil || len(files) != 1 {
+			t.Errorf("%s wrapper: unexpected files: %v, %v", wrapperName, files, err)
+		}
+
+		if err := writeFileTo(filepath.Join(sub, "missing", "file"), strings.NewReader(""), attrs, cmdWrapper); err == nil {
+			t.Errorf("%s wrapper: expected error", wrapperName)
+		}
+	}
+
+	if content, err := ioutil.ReadFile(target); err != nil || string(content) != "target" {
+		t.Errorf("symlink target is modified: %q, %v", content, err)
+	}
+}
@@ -0,0 +1,88 @@
+package chroot
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+type fstabEntry struct {
+	Spec       string
+	File       string
+	Filesystem string
+	Options    []string
+}
+
+// ignoredFilesystems is a list of filesystems which are not backed by a
+// partition of the image.
+var ignoredFilesystems = map[string]bool{
+	"swap":     true,
+	"none":     true,
+	"tmpfs":    true,
+	"proc":     true,
+	"sysfs":    true,
+	"devpts":   true,
+	"nfs":      true,
+	"nfs4":     true,
+	"cifs":     true,
+	"bind":     true,
+	"overlay":  true,
+	"squashfs": true,
+}
+
+// parseFstab parses fstab and returns the entries of the filesystems to
+// be mounted except for the root filesystem.
+func parseFstab(r io.Reader) ([]fstabEntry, error) {
+	entries := []fstabEntry{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		e := fstabEntry{
+			Spec:       unescapeMountField(fields[0]),
+			File:       unescapeMountField(fields[1]),
+			Filesystem: fields[2],
+		}
+
+		if e.File == "/" || !strings.HasPrefix(e.File, "/") || ignoredFilesystems[e.Filesystem] {
+			continue
+		}
+
+		noauto := false
+		if len(fields) > 3 {
+			for _, opt := range strings.Split(fields[3], ",") {
+				switch {
+				case opt == "noauto":
+					noauto = true
+				case opt == "defaults", opt == "auto", opt == "nofail", opt == "_netdev",
+					opt == "user", opt == "nouser", opt == "users", opt == "owner", opt == "group",
+					strings.HasPrefix(opt, "x-"), strings.HasPrefix(opt, "comment="):
+					// These options are only meaningful for the system using the fstab.
+				default:
+					e.Options = append(e.Options, opt)
+				}
+			}
+		}
+
+		if noauto {
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,130 @@
+package chroot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Compression types of the source image.
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionXz   = "xz"
+	compressionZstd = "zstd"
+)
+
+var compressionMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{compressionGzip, []byte{0x1f, 0x8b}},
+	{compressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{compressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// imageFormats is a list of image formats supported as source_format.
+var imageFormats = []string{"qcow2", "raw", "vmdk", "vdi", "vhdx", "vpc", "qed"}
+
+type imageInfo struct {
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+	ActualSize  int64  `json:"actual-size"`
+}
+
+// detectCompression returns the compression type of the file by its magic
+// number.
+func detectCompression(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 6)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	for _, c := range compressionMagics {
+		if bytes.HasPrefix(buf[:n], c.magic) {
+			return c.name, nil
+		}
+	}
+
+	return compressionNone, nil
+}
+
+// decompressImage decompresses the src file into dst file.
+func decompressImage(src, dst, compression string) error {
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	switch compression {
+	case compressionGzip:
+		r, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		if _, err := io.Copy(out, r); err != nil {
+			return err
+		}
+	case compressionXz, compressionZstd:
+		cmd := exec.Command(compression, "-d", "-c")
+		cmd.Stdin = in
+		cmd.Stdout = out
+		cmd.Stderr = new(bytes.Buffer)
+		log.Printf("Decompress command: %s %#v", cmd.Path, cmd.Args)
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s\n%s", err, cmd.Stderr)
+		}
+	default:
+		return fmt.Errorf("unsupported compression: %s", compression)
+	}
+
+	return out.Sync()
+}
+
+// inspectImage returns the information of the image using qemu-img.
+func inspectImage(path string, cmdWrapper CommandWrapper) (*imageInfo, error) {
+	cmd, err := cmdWrapper(fmt.Sprintf("qemu-img info --output=json %s", path))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Image info command: %s", cmd)
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	shell := NewShellCommand(cmd)
+	shell.Stdout = stdout
+	shell.Stderr = stderr
+	if err := shell.Run(); err != nil {
+		return nil, fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	info := new(imageInfo)
+	if err := json.Unmarshal(stdout.Bytes(), info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
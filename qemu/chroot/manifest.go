@@ -0,0 +1,52 @@
+package chroot
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+)
+
+const manifestName = "manifest.json"
+
+// Manifest represents the metadata of the build written to manifest.json.
+type Manifest struct {
+	BuilderID          string          `json:"builder_id"`
+	BuildName          string          `json:"build_name"`
+	Images             []ImageMetadata `json:"images"`
+	SourceImage        string          `json:"source_image,omitempty"`
+	SourceChecksum     string          `json:"source_checksum,omitempty"`
+	SourceChecksumType string          `json:"source_checksum_type,omitempty"`
+	Partitions         []partitionInfo `json:"partitions"`
+	StartedAt          time.Time       `json:"started_at"`
+	FinishedAt         time.Time       `json:"finished_at"`
+}
+
+// ImageMetadata represents the metadata of an image file.
+type ImageMetadata struct {
+	Path        string `json:"path"`
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual_size"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	SHA512      string `json:"sha512"`
+}
+
+// fileChecksums returns the SHA256 and SHA512 checksums of the file.
+func fileChecksums(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	h256 := sha256.New()
+	h512 := sha512.New()
+	if _, err := io.Copy(io.MultiWriter(h256, h512), f); err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(h256.Sum(nil)), hex.EncodeToString(h512.Sum(nil)), nil
+}
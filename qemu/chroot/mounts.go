@@ -0,0 +1,113 @@
+package chroot
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type mountEntry struct {
+	Source     string
+	Target     string
+	Filesystem string
+	Options    string
+}
+
+// procMountInfo is the mount information of the mount namespace of the
+// process.
+var procMountInfo = "/proc/self/mountinfo"
+
+// readMounts returns the mounted filesystems listed in mountinfo. Unlike
+// /proc/mounts, mountinfo separates the variable number of optional
+// fields from the filesystem type and the source explicitly.
+func readMounts() ([]mountEntry, error) {
+	f, err := os.Open(procMountInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []mountEntry{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root target options [optional...] - fstype source super-options
+		fields := strings.Fields(scanner.Text())
+
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+
+		if sep == -1 || len(fields) < sep+4 {
+			continue
+		}
+
+		mounts = append(mounts, mountEntry{
+			Source:     unescapeMountField(fields[sep+2]),
+			Target:     unescapeMountField(fields[4]),
+			Filesystem: fields[sep+1],
+			Options:    fields[5],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// isMounted returns true if a filesystem is mounted on path.
+func isMounted(path string) (bool, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return false, err
+	}
+
+	path = filepath.Clean(path)
+	for _, m := range mounts {
+		if m.Target == path {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// unescapeMountField decodes the octal escapes such as "\040" used for
+// whitespace in mountinfo.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			c := 0
+			valid := true
+			for _, d := range s[i+1 : i+4] {
+				if d < '0' || d > '7' {
+					valid = false
+					break
+				}
+				c = c*8 + int(d-'0')
+			}
+
+			if valid {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
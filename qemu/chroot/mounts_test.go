@@ -0,0 +1,92 @@
+package chroot
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const testMountInfo = `23 28 0:22 / /proc rw,relatime shared:12 - proc proc rw
+28 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+40 28 43:1 / /mnt/packer\040builder rw,relatime shared:20 master:1 - ext4 /dev/nbd0p1 rw
+41 40 43:2 /boot /mnt/packer\040builder/boot rw,relatime - vfat /dev/nbd0p2 rw,fmask=0022
+42 40 0:6 / /mnt/packer\040builder/dev rw,relatime - devtmpfs udev rw
+invalid line
+`
+
+func TestReadMounts(t *testing.T) {
+	f, err := ioutil.TempFile("", "mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(testMountInfo); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	orig := procMountInfo
+	procMountInfo = f.Name()
+	defer func() { procMountInfo = orig }()
+
+	mounts, err := readMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []mountEntry{
+		{Source: "proc", Target: "/proc", Filesystem: "proc", Options: "rw,relatime"},
+		{Source: "/dev/nvme0n1p2", Target: "/", Filesystem: "ext4", Options: "rw,relatime"},
+		{Source: "/dev/nbd0p1", Target: "/mnt/packer builder", Filesystem: "ext4", Options: "rw,relatime"},
+		{Source: "/dev/nbd0p2", Target: "/mnt/packer builder/boot", Filesystem: "vfat", Options: "rw,relatime"},
+		{Source: "udev", Target: "/mnt/packer builder/dev", Filesystem: "devtmpfs", Options: "rw,relatime"},
+	}
+
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected %#v, got %#v", expected, mounts)
+	}
+
+	cases := []struct {
+		path     string
+		expected bool
+	}{
+		{"/mnt/packer builder", true},
+		{"/mnt/packer builder/", true},
+		{"/mnt/packer builder/dev", true},
+		{"/mnt/packer builder/sys", false},
+		{"/mnt/packer\\040builder", false},
+	}
+
+	for _, c := range cases {
+		actual, err := isMounted(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.path, c.expected, actual)
+		}
+	}
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	cases := []struct {
+		field    string
+		expected string
+	}{
+		{"/mnt/chroot", "/mnt/chroot"},
+		{`/mnt/a\040b`, "/mnt/a b"},
+		{`/mnt/a\011b\012`, "/mnt/a\tb\n"},
+		{`/mnt/a\134b`, `/mnt/a\b`},
+		{`/mnt/a\09`, `/mnt/a\09`},
+		{`/mnt/a\04`, `/mnt/a\04`},
+	}
+
+	for _, c := range cases {
+		if actual := unescapeMountField(c.field); actual != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.field, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package chroot
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lookupOwner resolves the user and the group, given as names or numeric
+// IDs, against /etc/passwd and /etc/group of the image at root rather than
+// the ones of the host. If the group is empty, the primary group of the
+// user is used. It returns -1 for the ID which is not specified.
+func lookupOwner(root, user, group string) (int, int, error) {
+	uid, gid := -1, -1
+
+	if user != "" {
+		if id, err := strconv.Atoi(user); err == nil {
+			uid = id
+		} else {
+			entry, err := lookupIDFile(filepath.Join(root, "etc", "passwd"), user)
+			if err != nil {
+				return -1, -1, fmt.Errorf("Error looking up user %s: %s", user, err)
+			}
+
+			// name:password:uid:gid:...
+			if len(entry) < 4 {
+				return -1, -1, fmt.Errorf("Invalid passwd entry of user: %s", user)
+			}
+
+			if uid, err = strconv.Atoi(entry[2]); err != nil {
+				return -1, -1, fmt.Errorf("Invalid uid of user %s: %s", user, entry[2])
+			}
+
+			if group == "" {
+				if gid, err = strconv.Atoi(entry[3]); err != nil {
+					return -1, -1, fmt.Errorf("Invalid gid of user %s: %s", user, entry[3])
+				}
+			}
+		}
+	}
+
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			gid = id
+		} else {
+			entry, err := lookupIDFile(filepath.Join(root, "etc", "group"), group)
+			if err != nil {
+				return -1, -1, fmt.Errorf("Error looking up group %s: %s", group, err)
+			}
+
+			// name:password:gid:members
+			if len(entry) < 3 {
+				return -1, -1, fmt.Errorf("Invalid group entry of group: %s", group)
+			}
+
+			if gid, err = strconv.Atoi(entry[2]); err != nil {
+				return -1, -1, fmt.Errorf("Invalid gid of group %s: %s", group, entry[2])
+			}
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// lookupIDFile returns the fields of the entry of name in the file formatted
+// as /etc/passwd or /etc/group.
+func lookupIDFile(path, name string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if fields[0] == name {
+			return fields, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("not found in %s", filepath.Base(path))
+}
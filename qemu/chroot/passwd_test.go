@@ -0,0 +1,115 @@
+package chroot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPasswd = `# comment
+root:x:0:0:root:/root:/bin/bash
+
+ubuntu:x:1000:1001:Ubuntu:/home/ubuntu:/bin/bash
+broken:x:1002
+badgid:x:1003:gid:Bad:/home/badgid:/bin/sh
+`
+
+const testGroup = `root:x:0:
+ubuntu:x:1001:
+docker:x:999:ubuntu
+broken:x
+`
+
+func TestLookupOwner(t *testing.T) {
+	root, err := ioutil.TempDir("", "chroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.Mkdir(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(testPasswd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "etc", "group"), []byte(testGroup), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		user  string
+		group string
+		uid   int
+		gid   int
+		err   bool
+	}{
+		{user: "", group: "", uid: -1, gid: -1},
+		{user: "1234", group: "", uid: 1234, gid: -1},
+		{user: "", group: "5678", uid: -1, gid: 5678},
+		{user: "1234", group: "5678", uid: 1234, gid: 5678},
+		{user: "root", group: "", uid: 0, gid: 0},
+		{user: "ubuntu", group: "", uid: 1000, gid: 1001},
+		{user: "ubuntu", group: "docker", uid: 1000, gid: 999},
+		{user: "ubuntu", group: "0", uid: 1000, gid: 0},
+		{user: "", group: "docker", uid: -1, gid: 999},
+		{user: "missing", err: true},
+		{group: "missing", err: true},
+		{user: "ubuntu", group: "missing", err: true},
+		{user: "broken", err: true},
+		{group: "broken", err: true},
+		{user: "badgid", err: true},
+		{user: "badgid", group: "docker", uid: 1003, gid: 999},
+		{user: "#", err: true},
+	}
+
+	for _, c := range cases {
+		uid, gid, err := lookupOwner(root, c.user, c.group)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q:%q: expected error", c.user, c.group)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q:%q: unexpected error: %s", c.user, c.group, err)
+			continue
+		}
+
+		if uid != c.uid || gid != c.gid {
+			t.Errorf("%q:%q: expected %d:%d, got %d:%d", c.user, c.group, c.uid, c.gid, uid, gid)
+		}
+	}
+}
+
+func TestLookupIDFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(testPasswd); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fields, err := lookupIDFile(f.Name(), "ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fields) != 7 || fields[2] != "1000" || fields[3] != "1001" {
+		t.Errorf("unexpected fields: %#v", fields)
+	}
+
+	if _, err := lookupIDFile(f.Name(), "missing"); err == nil {
+		t.Error("missing: expected error")
+	}
+
+	if _, err := lookupIDFile(filepath.Join(os.TempDir(), "missing-passwd"), "root"); err == nil {
+		t.Error("missing file: expected error")
+	}
+}
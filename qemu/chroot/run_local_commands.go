@@ -0,0 +1,47 @@
+package chroot
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+// RunLocalCommands runs given commands on the host with the command wrapper.
+func RunLocalCommands(commands []string, cmdWrapper CommandWrapper, ctx interpolate.Context, ui packer.Ui) error {
+	for _, rawCmd := range commands {
+		intCmd, err := interpolate.Render(rawCmd, &ctx)
+		if err != nil {
+			return fmt.Errorf("Error interpolating: %s", err)
+		}
+
+		cmd, err := cmdWrapper(intCmd)
+		if err != nil {
+			return fmt.Errorf("Error wrapping command: %s", err)
+		}
+
+		ui.Say(fmt.Sprintf("Executing command: %s", cmd))
+		log.Printf("Local command: %s", cmd)
+
+		output := new(bytes.Buffer)
+		shell := NewShellCommand(cmd)
+		shell.Stdout = output
+		shell.Stderr = output
+		err = shell.Run()
+
+		for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+			if line != "" {
+				ui.Message(line)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("Error executing command: %s", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+type volumeGroup struct {
+	Name string
+	UUID string
+
+	// OriginalName is the name of the volume group in the image if it
+	// was renamed to avoid a collision with the host.
+	OriginalName string
+}
+
+// StepActivateVolumeGroups activates the LVM volume groups on the device
+// and selects the logical volume containing the root filesystem.
+type StepActivateVolumeGroups struct {
+	volumeGroups []volumeGroup
+}
+
+func (s *StepActivateVolumeGroups) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	luksDevice := ""
+	if v, ok := state.GetOk("luks_device"); ok {
+		luksDevice = v.(string)
+	}
+
+	s.volumeGroups = []volumeGroup{}
+	state.Put("lvm_cleanup", s)
+
+	if !config.ActivateLVM {
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Activating LVM volume groups...")
+
+	output, err := runLVMCommand("pvs --noheadings --separator : -o pv_name,vg_name,vg_uuid", cmdWrapper)
+	if err != nil {
+		err := fmt.Errorf("Error listing physical volumes: %s", err)
+		return halt(state, err)
+	}
+
+	// Collect the volume groups on the device and on the host.
+	pvs := []string{}
+	vgs := []volumeGroup{}
+	hostVGs := map[string]bool{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 3 || fields[1] == "" {
+			continue
+		}
+
+		// The physical volume may be on the decrypted LUKS device.
+		pv, name, uuid := fields[0], fields[1], fields[2]
+		if !strings.HasPrefix(pv, device+"p") && pv != luksDevice {
+			hostVGs[name] = true
+			continue
+		}
+
+		pvs = append(pvs, pv)
+
+		if !seen[uuid] {
+			seen[uuid] = true
+			vgs = append(vgs, volumeGroup{Name: name, UUID: uuid})
+		}
+	}
+
+	if len(vgs) == 0 {
+		err := errors.New("No LVM volume group found on the device")
+		return halt(state, err)
+	}
+
+	for _, vg := range vgs {
+		if hostVGs[vg.Name] {
+			tmpName := fmt.Sprintf("packer-%s-%s", vg.Name, vg.UUID[:6])
+			ui.Message(fmt.Sprintf("Renaming volume group %s to %s temporarily to avoid a collision with the host", vg.Name, tmpName))
+
+			if _, err := runLVMCommand(fmt.Sprintf("vgrename %s %s", vg.UUID, tmpName), cmdWrapper); err != nil {
+				err := fmt.Errorf("Error renaming volume group: %s", err)
+				return halt(state, err)
+			}
+
+			vg.OriginalName = vg.Name
+			vg.Name = tmpName
+		}
+
+		// Record the volume group before activating it so that it is
+		// restored in cleanup.
+		s.volumeGroups = append(s.volumeGroups, vg)
+
+		ui.Message(fmt.Sprintf("Activating: %s", vg.Name))
+		if _, err := runLVMCommand(fmt.Sprintf("vgchange -ay %s", vg.Name), cmdWrapper); err != nil {
+			err := fmt.Errorf("Error activating volume group: %s", err)
+			return halt(state, err)
+		}
+	}
+
+	if config.RootLogicalVolume != "" {
+		rootDevice, err := s.logicalVolumePath(config.RootLogicalVolume)
+		if err != nil {
+			err := fmt.Errorf("Error finding root logical volume: %s", err)
+			return halt(state, err)
+		}
+
+		ui.Message(fmt.Sprintf("Root logical volume: %s", rootDevice))
+		state.Put("root_device", rootDevice)
+
+		if config.DiskSize != "" && !config.FromScratch {
+			if err := growLogicalVolume(ui, pvs, rootDevice, cmdWrapper); err != nil {
+				return halt(state, err)
+			}
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+// logicalVolumePath returns the device path of the logical volume given as
+// "vg/lv", or "lv" if there is only one volume group.
+func (s *StepActivateVolumeGroups) logicalVolumePath(name string) (string, error) {
+	parts := strings.SplitN(name, "/", 2)
+
+	var vg *volumeGroup
+	lv := parts[len(parts)-1]
+
+	if len(parts) == 1 {
+		if len(s.volumeGroups) != 1 {
+			return "", fmt.Errorf("volume group must be specified as 'vg/lv' since there are %d volume groups", len(s.volumeGroups))
+		}
+
+		vg = &s.volumeGroups[0]
+	} else {
+		for i := range s.volumeGroups {
+			if s.volumeGroups[i].Name == parts[0] || s.volumeGroups[i].OriginalName == parts[0] {
+				vg = &s.volumeGroups[i]
+				break
+			}
+		}
+
+		if vg == nil {
+			return "", fmt.Errorf("volume group not found: %s", parts[0])
+		}
+	}
+
+	// Device mapper escapes hyphens in names by doubling them.
+	escape := func(s string) string { return strings.Replace(s, "-", "--", -1) }
+
+	return fmt.Sprintf("/dev/mapper/%s-%s", escape(vg.Name), escape(lv)), nil
+}
+
+func (s *StepActivateVolumeGroups) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *StepActivateVolumeGroups) CleanupFunc(state multistep.StateBag) error {
+	ui := state.Get("ui").(packer.Ui)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if len(s.volumeGroups) == 0 {
+		return nil
+	}
+
+	ui.Say("Deactivating LVM volume groups...")
+
+	for i := len(s.volumeGroups) - 1; i >= 0; i-- {
+		vg := s.volumeGroups[i]
+
+		if _, err := runLVMCommand(fmt.Sprintf("vgchange -an %s", vg.Name), cmdWrapper); err != nil {
+			return fmt.Errorf("Error deactivating volume group: %s", err)
+		}
+
+		if vg.OriginalName != "" {
+			log.Printf("Restoring the name of volume group %s to %s", vg.Name, vg.OriginalName)
+			if _, err := runLVMCommand(fmt.Sprintf("vgrename %s %s", vg.UUID, vg.OriginalName), cmdWrapper); err != nil {
+				return fmt.Errorf("Error restoring the name of volume group: %s", err)
+			}
+		}
+
+		s.volumeGroups = s.volumeGroups[:i]
+	}
+
+	return nil
+}
+
+// growLogicalVolume resizes the physical volumes to fill their grown
+// partitions and extends the logical volume and its filesystem to use all
+// free space of the volume group.
+func growLogicalVolume(ui packer.Ui, pvs []string, lv string, cmdWrapper CommandWrapper) error {
+	ui.Say("Growing logical volume...")
+
+	for _, pv := range pvs {
+		if _, err := runLVMCommand(fmt.Sprintf("pvresize %s", pv), cmdWrapper); err != nil {
+			return fmt.Errorf("Error resizing physical volume: %s", err)
+		}
+	}
+
+	output, err := runLVMCommand(fmt.Sprintf("lvs --noheadings -o vg_free_count %s", lv), cmdWrapper)
+	if err != nil {
+		return fmt.Errorf("Error checking free space of volume group: %s", err)
+	}
+
+	// lvextend fails if there is no free extent.
+	if strings.TrimSpace(output) == "0" {
+		ui.Message("Logical volume already fills the volume group")
+		return nil
+	}
+
+	if _, err := runLVMCommand(fmt.Sprintf("lvextend -r -l +100%%FREE %s", lv), cmdWrapper); err != nil {
+		return fmt.Errorf("Error extending logical volume: %s", err)
+	}
+
+	return nil
+}
+
+func runLVMCommand(command string, cmdWrapper CommandWrapper) (string, error) {
+	cmd, err := cmdWrapper(command)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("LVM command: %s", cmd)
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	shell := NewShellCommand(cmd)
+	shell.Stdout = stdout
+	shell.Stderr = stderr
+	if err := shell.Run(); err != nil {
+		return "", fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,176 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepBootContainer boots the image as a container with systemd-nspawn when
+// nspawn_boot is true, so that provisioners can use systemctl.
+type StepBootContainer struct {
+	machine string
+	cmd     *exec.Cmd
+	done    chan struct{}
+}
+
+func (s *StepBootContainer) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	mountPath := state.Get("mount_path").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	s.cmd = nil
+	state.Put("container_cleanup", s)
+
+	if config.ExecutionMode != executionModeNspawn || !config.NspawnBoot {
+		return multistep.ActionContinue
+	}
+
+	s.machine = fmt.Sprintf("packer-%s", filepath.Base(device))
+	state.Put("machine", s.machine)
+
+	ui.Say(fmt.Sprintf("Booting container: %s", s.machine))
+
+	args := append([]string{
+		"systemd-nspawn",
+		"--quiet",
+		"--boot",
+		"--console=passive",
+		fmt.Sprintf("--directory=%s", mountPath),
+		fmt.Sprintf("--machine=%s", s.machine),
+	}, config.NspawnArgs...)
+
+	cmd, err := NewWrappedCommand(args, cmdWrapper)
+	if err != nil {
+		err := fmt.Errorf("Error creating nspawn command: %s", err)
+		return halt(state, err)
+	}
+
+	log.Printf("Nspawn command: %s %#v", cmd.Path, cmd.Args)
+
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		err := fmt.Errorf("Error booting container: %s", err)
+		return halt(state, err)
+	}
+
+	s.cmd = cmd
+	s.done = make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		log.Printf("Container %s exited: %v", s.machine, err)
+		close(s.done)
+	}()
+
+	ui.Message("Waiting for the container to finish booting...")
+
+	exited := false
+	err = waitFor(config.bootTimeout, func() bool {
+		select {
+		case <-s.done:
+			exited = true
+			return true
+		default:
+		}
+
+		status, err := s.systemState(cmdWrapper)
+		if err != nil {
+			log.Printf("Error getting system state: %s", err)
+			return false
+		}
+
+		log.Printf("System state of container %s: %s", s.machine, status)
+		return status == "running" || status == "degraded"
+	})
+
+	if exited {
+		err := fmt.Errorf("Container exited while booting\n%s", stderr)
+		return halt(state, err)
+	}
+
+	if err != nil {
+		err := fmt.Errorf("Error waiting for the container to boot: %s", err)
+		return halt(state, err)
+	}
+
+	return multistep.ActionContinue
+}
+
+// systemState returns the system state of the container reported by
+// systemctl is-system-running.
+func (s *StepBootContainer) systemState(cmdWrapper CommandWrapper) (string, error) {
+	cmd, err := cmdWrapper(fmt.Sprintf("systemctl --machine=%s is-system-running", s.machine))
+	if err != nil {
+		return "", err
+	}
+
+	// is-system-running exits with non-zero status unless the system is
+	// running, so the output is checked instead.
+	stdout := new(bytes.Buffer)
+	shell := NewShellCommand(cmd)
+	shell.Stdout = stdout
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil && stdout.Len() == 0 {
+		return "", fmt.Errorf("%s\n%s", err, shell.Stderr)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (s *StepBootContainer) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *StepBootContainer) CleanupFunc(state multistep.StateBag) error {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if s.cmd == nil {
+		return nil
+	}
+
+	ui.Say(fmt.Sprintf("Stopping container: %s", s.machine))
+
+	for _, action := range []string{"poweroff", "terminate"} {
+		select {
+		case <-s.done:
+		default:
+			cmd, err := cmdWrapper(fmt.Sprintf("machinectl %s %s", action, s.machine))
+			if err != nil {
+				return fmt.Errorf("Error creating machinectl command: %s", err)
+			}
+
+			log.Printf("Machinectl command: %s", cmd)
+
+			shell := NewShellCommand(cmd)
+			shell.Stderr = new(bytes.Buffer)
+			if err := shell.Run(); err != nil {
+				log.Printf("Error running machinectl %s: %s\n%s", action, err, shell.Stderr)
+			}
+		}
+
+		select {
+		case <-s.done:
+			s.cmd = nil
+			return nil
+		case <-time.After(config.bootTimeout):
+		}
+	}
+
+	return fmt.Errorf("Error stopping container: %s did not exit", s.machine)
+}
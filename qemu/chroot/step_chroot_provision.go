@@ -11,14 +11,31 @@ import (
 type StepChrootProvision struct{}
 
 func (s *StepChrootProvision) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
 	hook := state.Get("hook").(packer.Hook)
 	mountPath := state.Get("mount_path").(string)
 	ui := state.Get("ui").(packer.Ui)
 	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
 
 	comm := &Communicator{
-		Chroot:     mountPath,
-		CmdWrapper: cmdWrapper,
+		Chroot:         mountPath,
+		CmdWrapper:     cmdWrapper,
+		ExecutionMode:  config.ExecutionMode,
+		NspawnArgs:     config.NspawnArgs,
+		ChrootMounts:   config.ChrootMounts,
+		UnshareNetwork: config.UnshareNetwork,
+		UploadOwner:    config.UploadOwner,
+		UploadGroup:    config.UploadGroup,
+	}
+
+	if machine, ok := state.GetOk("machine"); ok {
+		comm.Machine = machine.(string)
+	}
+
+	// systemctl does not start or stop services in offline mode. The
+	// booted container runs its own systemd, which must not be bypassed.
+	if config.PreventServiceStart && comm.Machine == "" {
+		comm.Env = append(comm.Env, "SYSTEMD_OFFLINE=1")
 	}
 
 	log.Println("Running the provision hook")
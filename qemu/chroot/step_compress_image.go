@@ -19,26 +19,40 @@ func (s *StepCompressImage) Run(_ context.Context, state multistep.StateBag) mul
 	imagePath := state.Get("image_path").(string)
 	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
 
-	if !config.Compression {
+	// The overlay image must be flattened unless the backing chain is kept.
+	flatten := config.UseBackingFile && !config.KeepBackingFile
+	if !config.Compression && !flatten {
 		return multistep.ActionContinue
 	}
 
-	ui.Say("Compressing image...")
+	args := []string{"qemu-img", "convert"}
+	if config.Compression {
+		ui.Say("Compressing image...")
+		args = append(args, "-c")
+	} else {
+		ui.Say("Flattening image...")
+	}
+
+	if config.KeepBackingFile {
+		sourcePath := state.Get("source_path").(string)
+		sourceFormat := state.Get("source_format").(string)
+		args = append(args, "-B", sourcePath, "-F", sourceFormat)
+	}
+
 	tmpPath := imagePath + ".tmp"
+	args = append(args, "-O", "qcow2", imagePath, tmpPath)
 
-	cmd := fmt.Sprintf("qemu-img convert -c -O qcow2 %s %s", imagePath, tmpPath)
-	cmd, err := cmdWrapper(cmd)
+	cmd, err := NewWrappedCommand(args, cmdWrapper)
 	if err != nil {
 		err := fmt.Errorf("Error creating compression command: %s", err)
 		return halt(state, err)
 	}
 
-	log.Printf("Compression command: %s", cmd)
+	log.Printf("Compression command: %s %#v", cmd.Path, cmd.Args)
 
-	shell := NewShellCommand(cmd)
-	shell.Stderr = new(bytes.Buffer)
-	if err := shell.Run(); err != nil {
-		err := fmt.Errorf("Error compressing image: %s\n%s", err, shell.Stderr)
+	cmd.Stderr = new(bytes.Buffer)
+	if err := cmd.Run(); err != nil {
+		err := fmt.Errorf("Error compressing image: %s\n%s", err, cmd.Stderr)
 		return halt(state, err)
 	}
 
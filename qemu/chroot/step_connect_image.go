@@ -1,11 +1,9 @@
 package chroot
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"log"
-	"time"
 
 	"github.com/hashicorp/packer/helper/multistep"
 	"github.com/hashicorp/packer/packer"
@@ -17,35 +15,65 @@ type StepConnectImage struct {
 
 func (s *StepConnectImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	device := state.Get("device").(string)
 	imagePath := state.Get("image_path").(string)
-	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+	backend := state.Get("device_backend").(DeviceBackend)
 
-	ui.Say("Connecting source image as a network block device...")
+	ui.Say("Attaching image to a block device...")
+	log.Printf("Target image path: %s", imagePath)
 
-	cmd, err := cmdWrapper(fmt.Sprintf("qemu-nbd -c %s %s", device, imagePath))
+	device, err := backend.Attach(state)
 	if err != nil {
-		err := fmt.Errorf("Error creating connect command: %s", err)
 		return halt(state, err)
 	}
 
-	log.Printf("Target image path: %s", imagePath)
-	log.Printf("Connect command: %s", cmd)
+	log.Printf("Device: %s", device)
+	state.Put("device", device)
+
+	s.device = device
+	state.Put("connect_image_cleanup", s)
 
-	shell := NewShellCommand(cmd)
-	shell.Stderr = new(bytes.Buffer)
-	if err := shell.Run(); err != nil {
-		err := fmt.Errorf("Error connecting to the source image: %s\n%s", err, shell.Stderr)
+	if err := s.waitForDevice(state, device); err != nil {
 		return halt(state, err)
 	}
 
-	// Wait for the device to be connected.
-	time.Sleep(1 * time.Second)
+	return multistep.ActionContinue
+}
 
-	s.device = device
-	state.Put("connect_image_cleanup", s)
+// waitForDevice waits until the device is connected and the partition to
+// be mounted appears.
+func (s *StepConnectImage) waitForDevice(state multistep.StateBag, device string) error {
+	config := state.Get("config").(*Config)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
 
-	return multistep.ActionContinue
+	log.Printf("Waiting for device to be connected: %s", device)
+	if err := waitForDeviceSize(device, config.deviceTimeout); err != nil {
+		return fmt.Errorf("Error waiting for device %s to be connected: %s", device, err)
+	}
+
+	if err := settleDevice(device, config, cmdWrapper); err != nil {
+		return fmt.Errorf("Error settling device: %s", err)
+	}
+
+	// The partitions are not created yet when building from scratch.
+	if config.FromScratch {
+		return nil
+	}
+
+	if config.MountPartition == 0 {
+		log.Println("Waiting for partitions to appear")
+		if err := waitForAnyPartitions(device, config.deviceTimeout); err != nil {
+			return fmt.Errorf("Error waiting for partitions of %s to appear: %s", device, err)
+		}
+
+		return nil
+	}
+
+	log.Printf("Waiting for partition %d to appear", config.MountPartition)
+	if err := waitForPartitions(device, []int{config.MountPartition}, config.deviceTimeout); err != nil {
+		return fmt.Errorf("Error waiting for partition %sp%d to appear: %s", device, config.MountPartition, err)
+	}
+
+	return nil
 }
 
 func (s *StepConnectImage) Cleanup(state multistep.StateBag) {
@@ -57,22 +85,15 @@ func (s *StepConnectImage) Cleanup(state multistep.StateBag) {
 
 func (s *StepConnectImage) CleanupFunc(state multistep.StateBag) error {
 	ui := state.Get("ui").(packer.Ui)
-	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+	backend := state.Get("device_backend").(DeviceBackend)
 
 	if s.device == "" {
 		return nil
 	}
 
-	ui.Say("Disconnecting the source image...")
-	cmd, err := cmdWrapper(fmt.Sprintf("qemu-nbd -d %s", s.device))
-	if err != nil {
-		return fmt.Errorf("Error creating disconnect command: %s", err)
-	}
-
-	shell := NewShellCommand(cmd)
-	shell.Stderr = new(bytes.Buffer)
-	if err := shell.Run(); err != nil {
-		return fmt.Errorf("Error disconnecting from source image: %s\n%s", err, shell.Stderr)
+	ui.Say("Detaching image from the block device...")
+	if err := backend.Detach(state, s.device); err != nil {
+		return err
 	}
 
 	s.device = ""
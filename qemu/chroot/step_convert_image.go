@@ -0,0 +1,93 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// outputFormats maps the supported output formats to their file extension.
+var outputFormats = map[string]string{
+	"qcow2": "qcow2",
+	"raw":   "raw",
+	"vmdk":  "vmdk",
+	"vhdx":  "vhdx",
+	"vdi":   "vdi",
+	"vpc":   "vhd",
+}
+
+// StepConvertImage converts the image into each of output_formats.
+type StepConvertImage struct{}
+
+func (s *StepConvertImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	imagePath := state.Get("image_path").(string)
+	imageFormat := state.Get("image_format").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	outputPaths := make([]string, 0, len(config.OutputFormats))
+
+	for _, f := range config.OutputFormats {
+		outputPath := filepath.Join(config.OutputDir, f.Filename)
+
+		ui.Say(fmt.Sprintf("Converting image to %s...", f.Format))
+
+		cmd, err := NewWrappedCommand(convertArgs(f, imageFormat, imagePath, outputPath), cmdWrapper)
+		if err != nil {
+			err := fmt.Errorf("Error creating conversion command: %s", err)
+			return halt(state, err)
+		}
+
+		log.Printf("Conversion command: %s %#v", cmd.Path, cmd.Args)
+
+		cmd.Stderr = new(bytes.Buffer)
+		if err := cmd.Run(); err != nil {
+			err := fmt.Errorf("Error converting image: %s\n%s", err, cmd.Stderr)
+			return halt(state, err)
+		}
+
+		outputPaths = append(outputPaths, outputPath)
+	}
+
+	state.Put("output_paths", outputPaths)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepConvertImage) Cleanup(state multistep.StateBag) {}
+
+// convertArgs returns the qemu-img arguments to convert the image.
+func convertArgs(f OutputFormatConfig, srcFormat, src, dst string) []string {
+	args := []string{"qemu-img", "convert", "-f", srcFormat, "-O", f.Format}
+
+	if f.Compression {
+		args = append(args, "-c")
+	}
+
+	opts := []string{}
+	if f.Subformat != "" {
+		opts = append(opts, "subformat="+f.Subformat)
+	}
+	if f.Compat != "" {
+		opts = append(opts, "compat="+f.Compat)
+	}
+	if f.ClusterSize != "" {
+		opts = append(opts, "cluster_size="+f.ClusterSize)
+	}
+	if f.CompressionType != "" {
+		opts = append(opts, "compression_type="+f.CompressionType)
+	}
+
+	if len(opts) > 0 {
+		args = append(args, "-o", strings.Join(opts, ","))
+	}
+
+	return append(args, src, dst)
+}
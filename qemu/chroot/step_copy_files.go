@@ -1,7 +1,6 @@
 package chroot
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"log"
@@ -29,19 +28,8 @@ func (s *StepCopyFiles) Run(_ context.Context, state multistep.StateBag) multist
 
 		ui.Message(fmt.Sprintf("Copying: %s", srcPath))
 
-		cmd := fmt.Sprintf("cp --remove-destination %s %s", srcPath, destPath)
-		cmd, err := cmdWrapper(cmd)
-		if err != nil {
-			err := fmt.Errorf("Error building copy command: %s", err)
-			return halt(state, err)
-		}
-
-		log.Printf("Copy command: %s", cmd)
-
-		shell := NewShellCommand(cmd)
-		shell.Stderr = new(bytes.Buffer)
-		if err := shell.Run(); err != nil {
-			err := fmt.Errorf("Error copying file: %s\n%s", err, shell.Stderr)
+		if err := copyFileTo(srcPath, destPath, cmdWrapper); err != nil {
+			err := fmt.Errorf("Error copying file: %s", err)
 			return halt(state, err)
 		}
 
@@ -70,15 +58,8 @@ func (s *StepCopyFiles) CleanupFunc(state multistep.StateBag) error {
 	for _, file := range s.files {
 		log.Printf("Removing file: %s", file)
 
-		cmd, err := cmdWrapper(fmt.Sprintf("rm -f %s", file))
-		if err != nil {
-			return err
-		}
-
-		shell := NewShellCommand(cmd)
-		shell.Stderr = new(bytes.Buffer)
-		if err := shell.Run(); err != nil {
-			return fmt.Errorf("Error removing file: %s\n%s", err, shell.Stderr)
+		if err := removeFile(file, cmdWrapper); err != nil {
+			return fmt.Errorf("Error removing file: %s", err)
 		}
 	}
 
@@ -12,9 +12,15 @@ type StepEarlyCleanup struct{}
 
 func (s *StepEarlyCleanup) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
 	keys := []string{
+		"container_cleanup",
+		"prevent_service_start_cleanup",
 		"copy_files_cleanup",
 		"mount_extra_cleanup",
+		"emulation_cleanup",
+		"mount_partitions_cleanup",
 		"mount_device_cleanup",
+		"lvm_cleanup",
+		"luks_cleanup",
 		"connect_image_cleanup",
 	}
 
@@ -0,0 +1,94 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepGrowFilesystem grows the mounted root filesystem to fill the
+// partition.
+type StepGrowFilesystem struct{}
+
+func (s *StepGrowFilesystem) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	rootDevice := state.Get("root_device").(string)
+	mountPath := state.Get("mount_path").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if config.DiskSize == "" || config.FromScratch {
+		return multistep.ActionContinue
+	}
+
+	fsType, err := filesystemType(rootDevice, cmdWrapper)
+	if err != nil {
+		err := fmt.Errorf("Error detecting filesystem type: %s", err)
+		return halt(state, err)
+	}
+
+	var cmd string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		cmd = fmt.Sprintf("resize2fs %s", rootDevice)
+	case "xfs":
+		cmd = fmt.Sprintf("xfs_growfs %s", mountPath)
+	case "btrfs":
+		cmd = fmt.Sprintf("btrfs filesystem resize max %s", mountPath)
+	case "zfs_member":
+		pool, ok := state.GetOk("zfs_pool")
+		if !ok {
+			err := fmt.Errorf("ZFS pool is not imported, specify zfs_pool to grow it")
+			return halt(state, err)
+		}
+		cmd = fmt.Sprintf("zpool online -e %s %s", pool, rootDevice)
+	default:
+		err := fmt.Errorf("Unsupported filesystem to grow: %s", fsType)
+		return halt(state, err)
+	}
+
+	ui.Say(fmt.Sprintf("Growing %s filesystem...", fsType))
+
+	cmd, err = cmdWrapper(cmd)
+	if err != nil {
+		err := fmt.Errorf("Error creating grow command: %s", err)
+		return halt(state, err)
+	}
+
+	log.Printf("Grow command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		err := fmt.Errorf("Error growing filesystem: %s\n%s", err, shell.Stderr)
+		return halt(state, err)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepGrowFilesystem) Cleanup(state multistep.StateBag) {}
+
+// filesystemType returns the filesystem type of the partition using blkid.
+func filesystemType(partition string, cmdWrapper CommandWrapper) (string, error) {
+	cmd, err := cmdWrapper(fmt.Sprintf("blkid -o value -s TYPE %s", partition))
+	if err != nil {
+		return "", err
+	}
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	shell := NewShellCommand(cmd)
+	shell.Stdout = stdout
+	shell.Stderr = stderr
+	if err := shell.Run(); err != nil {
+		return "", fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
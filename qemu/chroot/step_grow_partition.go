@@ -0,0 +1,95 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepGrowPartition grows the root partition to fill the resized device.
+type StepGrowPartition struct{}
+
+func (s *StepGrowPartition) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	partition := state.Get("root_partition").(int)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if config.DiskSize == "" || config.FromScratch {
+		return multistep.ActionContinue
+	}
+
+	// The root filesystem on an LVM logical volume is grown by growing the
+	// partition of the physical volume. With LVM on LUKS, the physical
+	// volume is on the encrypted root partition.
+	if config.RootLogicalVolume != "" && config.LUKSPassphrase == "" && config.LUKSKeyFile == "" {
+		num, err := physicalVolumePartition(device, cmdWrapper)
+		if err != nil {
+			err := fmt.Errorf("Error finding physical volume partition: %s", err)
+			return halt(state, err)
+		}
+
+		partition = num
+	}
+
+	ui.Say("Growing partition...")
+
+	cmd := fmt.Sprintf("growpart %s %d", device, partition)
+	cmd, err := cmdWrapper(cmd)
+	if err != nil {
+		err := fmt.Errorf("Error creating growpart command: %s", err)
+		return halt(state, err)
+	}
+
+	log.Printf("Growpart command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stdout = new(bytes.Buffer)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		// growpart exits with 1 if the partition cannot be grown any more.
+		if strings.HasPrefix(fmt.Sprint(shell.Stdout), "NOCHANGE") {
+			ui.Message("Partition already fills the device")
+			return multistep.ActionContinue
+		}
+
+		err := fmt.Errorf("Error growing partition: %s\n%s", err, shell.Stderr)
+		return halt(state, err)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepGrowPartition) Cleanup(state multistep.StateBag) {}
+
+// physicalVolumePartition returns the number of the last LVM physical
+// volume partition on the device, which is the one that can be grown.
+func physicalVolumePartition(device string, cmdWrapper CommandWrapper) (int, error) {
+	partitions, err := listPartitions(device, cmdWrapper)
+	if err != nil {
+		return 0, err
+	}
+
+	var pv *partitionInfo
+	for i, p := range partitions {
+		if p.Filesystem != "LVM2_member" {
+			continue
+		}
+
+		if pv == nil || p.Start > pv.Start {
+			pv = &partitions[i]
+		}
+	}
+
+	if pv == nil {
+		return 0, fmt.Errorf("no LVM physical volume found on %s", device)
+	}
+
+	return pv.Number, nil
+}
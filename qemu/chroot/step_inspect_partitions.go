@@ -0,0 +1,33 @@
+package chroot
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/packer/helper/multistep"
+)
+
+// StepInspectPartitions records the partition layout of the device.
+type StepInspectPartitions struct{}
+
+func (s *StepInspectPartitions) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	device := state.Get("device").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	partitions, err := listPartitions(device, cmdWrapper)
+	if err != nil {
+		err := fmt.Errorf("Error inspecting partitions: %s", err)
+		return halt(state, err)
+	}
+
+	for _, p := range partitions {
+		log.Printf("Partition: %s (%s, %d bytes)", p.Device, p.Filesystem, p.Size)
+	}
+
+	state.Put("partitions", partitions)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepInspectPartitions) Cleanup(state multistep.StateBag) {}
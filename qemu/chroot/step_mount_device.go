@@ -20,12 +20,14 @@ type mountPathData struct {
 
 type StepMountDevice struct {
 	mountPath string
+	zfsPool   string
 }
 
 func (s *StepMountDevice) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
 	config := state.Get("config").(*Config)
 	ui := state.Get("ui").(packer.Ui)
 	device := state.Get("device").(string)
+	rootDevice := state.Get("root_device").(string)
 	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
 
 	ctx := config.ctx
@@ -50,18 +52,88 @@ func (s *StepMountDevice) Run(_ context.Context, state multistep.StateBag) multi
 		return halt(state, err)
 	}
 
+	if config.ZFSPool != "" {
+		ui.Say("Importing ZFS pool...")
+
+		pool, err := importZFSPool(config.ZFSPool, config.ZFSRootDataset, rootDevice, mountPath, cmdWrapper)
+		if pool != "" {
+			s.zfsPool = pool
+			state.Put("mount_device_cleanup", s)
+		}
+		if err != nil {
+			return halt(state, err)
+		}
+
+		state.Put("zfs_pool", pool)
+		s.mountPath = mountPath
+		state.Put("mount_path", mountPath)
+
+		return multistep.ActionContinue
+	}
+
 	ui.Say("Mounting device...")
 
+	options := config.MountOptions
+	if config.BtrfsRootSubvolume != "" {
+		options = append(append([]string{}, options...), "subvol="+config.BtrfsRootSubvolume)
+	}
+
+	if err := s.mount(state, rootDevice, mountPath, options); err != nil {
+		return halt(state, err)
+	}
+
+	s.mountPath = mountPath
+	state.Put("mount_path", mountPath)
+	state.Put("mount_device_cleanup", s)
+
+	// Some distributions keep the root filesystem in a btrfs subvolume
+	// which is not the default subvolume.
+	if config.BtrfsRootSubvolume == "" && !config.FromScratch {
+		fsType, err := filesystemType(rootDevice, cmdWrapper)
+		if err != nil {
+			err := fmt.Errorf("Error detecting filesystem type: %s", err)
+			return halt(state, err)
+		}
+
+		if fsType == "btrfs" {
+			subvol, err := findBtrfsRootSubvolume(mountPath, cmdWrapper)
+			if err != nil {
+				err := fmt.Errorf("Error finding btrfs root subvolume: %s", err)
+				return halt(state, err)
+			}
+
+			if subvol != "" {
+				ui.Message(fmt.Sprintf("Remounting btrfs root subvolume: %s", subvol))
+
+				if err := s.CleanupFunc(state); err != nil {
+					return halt(state, err)
+				}
+
+				options = append(append([]string{}, options...), "subvol="+subvol)
+				if err := s.mount(state, rootDevice, mountPath, options); err != nil {
+					return halt(state, err)
+				}
+
+				s.mountPath = mountPath
+			}
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepMountDevice) mount(state multistep.StateBag, device, mountPath string, options []string) error {
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
 	opts := ""
-	if len(config.MountOptions) > 0 {
-		opts = "-o " + strings.Join(config.MountOptions, " -o ")
+	if len(options) > 0 {
+		opts = "-o " + strings.Join(options, " -o ")
 	}
 
-	cmd := fmt.Sprintf("mount %s %sp%d %s", opts, device, config.MountPartition, mountPath)
-	cmd, err = cmdWrapper(cmd)
+	cmd := fmt.Sprintf("mount %s %s %s", opts, device, mountPath)
+	cmd, err := cmdWrapper(cmd)
 	if err != nil {
-		err := fmt.Errorf("Error creating mount command: %s", err)
-		return halt(state, err)
+		return fmt.Errorf("Error creating mount command: %s", err)
 	}
 
 	log.Printf("Mount command: %s", cmd)
@@ -69,15 +141,10 @@ func (s *StepMountDevice) Run(_ context.Context, state multistep.StateBag) multi
 	shell := NewShellCommand(cmd)
 	shell.Stderr = new(bytes.Buffer)
 	if err := shell.Run(); err != nil {
-		err := fmt.Errorf("Error mounting device: %s\n%s", err, shell.Stderr)
-		return halt(state, err)
+		return fmt.Errorf("Error mounting device: %s\n%s", err, shell.Stderr)
 	}
 
-	s.mountPath = mountPath
-	state.Put("mount_path", mountPath)
-	state.Put("mount_device_cleanup", s)
-
-	return multistep.ActionContinue
+	return nil
 }
 
 func (s *StepMountDevice) Cleanup(state multistep.StateBag) {
@@ -91,6 +158,18 @@ func (s *StepMountDevice) CleanupFunc(state multistep.StateBag) error {
 	ui := state.Get("ui").(packer.Ui)
 	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
 
+	if s.zfsPool != "" {
+		ui.Say("Exporting ZFS pool...")
+		if err := exportZFSPool(s.zfsPool, cmdWrapper); err != nil {
+			return err
+		}
+
+		s.zfsPool = ""
+		s.mountPath = ""
+
+		return nil
+	}
+
 	if s.mountPath == "" {
 		return nil
 	}
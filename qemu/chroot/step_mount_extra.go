@@ -6,10 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
-	"syscall"
 
 	"github.com/hashicorp/packer/helper/multistep"
 	"github.com/hashicorp/packer/packer"
@@ -27,6 +24,13 @@ func (s *StepMountExtra) Run(_ context.Context, state multistep.StateBag) multis
 
 	s.mountPaths = make([]string, 0, len(config.ChrootMounts))
 
+	// The paths are mounted in the mount namespace of each command with
+	// the unshare execution mode.
+	if config.ExecutionMode == executionModeUnshare {
+		state.Put("mount_extra_cleanup", s)
+		return multistep.ActionContinue
+	}
+
 	ui.Say("Mounting additional paths within the chroot...")
 	for _, mountInfo := range config.ChrootMounts {
 		p := filepath.Join(mountPath, mountInfo[2])
@@ -38,29 +42,17 @@ func (s *StepMountExtra) Run(_ context.Context, state multistep.StateBag) multis
 
 		ui.Message(fmt.Sprintf("Mounting: %s", mountInfo[2]))
 
-		flags := "-t " + mountInfo[0]
-		if mountInfo[0] == "bind" {
-			flags = "--bind"
-		}
-
-		opts := ""
-		if len(mountInfo) > 3 {
-			opts = "-o " + strings.Join(mountInfo[3:], " -o ")
-		}
-
-		cmd := fmt.Sprintf("mount %s %s %s %s", flags, opts, mountInfo[1], p)
-		cmd, err := cmdWrapper(cmd)
+		cmd, err := NewWrappedCommand(chrootMountArgs(mountInfo, p), cmdWrapper)
 		if err != nil {
 			err := fmt.Errorf("Error creating mount command: %s", err)
 			return halt(state, err)
 		}
 
-		log.Printf("Mount command: %s", cmd)
+		log.Printf("Mount command: %s %#v", cmd.Path, cmd.Args)
 
-		shell := NewShellCommand(cmd)
-		shell.Stderr = new(bytes.Buffer)
-		if err := shell.Run(); err != nil {
-			err := fmt.Errorf("Error mounting path: %s\n%s", err, shell.Stderr)
+		cmd.Stderr = new(bytes.Buffer)
+		if err := cmd.Run(); err != nil {
+			err := fmt.Errorf("Error mounting path: %s\n%s", err, cmd.Stderr)
 			return halt(state, err)
 		}
 
@@ -93,34 +85,23 @@ func (s *StepMountExtra) CleanupFunc(state multistep.StateBag) error {
 	for i := lastIndex; i >= 0; i-- {
 		path := s.mountPaths[i]
 
-		cmd, err := cmdWrapper(fmt.Sprintf("grep %s /proc/mounts", path))
+		mounted, err := isMounted(path)
 		if err != nil {
-			return fmt.Errorf("Error creating grep command: %s", err)
+			return fmt.Errorf("Error reading mounts: %s", err)
 		}
 
-		shell := NewShellCommand(cmd)
-		shell.Stderr = new(bytes.Buffer)
-		if err := shell.Run(); err != nil {
-			if exitError, ok := err.(*exec.ExitError); ok {
-				exitStatus := 0
-				if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
-					exitStatus = status.ExitStatus()
-				}
-				if exitStatus == 1 {
-					continue
-				}
-			}
+		if !mounted {
+			continue
 		}
 
-		cmd, err = cmdWrapper(fmt.Sprintf("umount %s", path))
+		cmd, err := NewWrappedCommand([]string{"umount", path}, cmdWrapper)
 		if err != nil {
 			return fmt.Errorf("Error creating unmount command: %s", err)
 		}
 
-		shell = NewShellCommand(cmd)
-		shell.Stderr = new(bytes.Buffer)
-		if err := shell.Run(); err != nil {
-			return fmt.Errorf("Error unmounting path: %s\n%s", err, shell.Stderr)
+		cmd.Stderr = new(bytes.Buffer)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Error unmounting path: %s\n%s", err, cmd.Stderr)
 		}
 	}
 
@@ -128,3 +109,18 @@ func (s *StepMountExtra) CleanupFunc(state multistep.StateBag) error {
 
 	return nil
 }
+
+// chrootMountArgs returns the arguments of the mount command of the
+// chroot_mounts entry on the path.
+func chrootMountArgs(mountInfo []string, path string) []string {
+	args := []string{"mount", "-t", mountInfo[0]}
+	if mountInfo[0] == "bind" {
+		args = []string{"mount", "--bind"}
+	}
+
+	for _, opt := range mountInfo[3:] {
+		args = append(args, "-o", opt)
+	}
+
+	return append(args, mountInfo[1], path)
+}
@@ -0,0 +1,32 @@
+package chroot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChrootMountArgs(t *testing.T) {
+	cases := []struct {
+		mountInfo []string
+		expected  []string
+	}{
+		{
+			[]string{"proc", "proc", "/proc"},
+			[]string{"mount", "-t", "proc", "proc", "/mnt/chroot dir/proc"},
+		},
+		{
+			[]string{"bind", "/dev", "/dev"},
+			[]string{"mount", "--bind", "/dev", "/mnt/chroot dir/proc"},
+		},
+		{
+			[]string{"tmpfs", "tmpfs", "/tmp", "size=1G", "mode=1777"},
+			[]string{"mount", "-t", "tmpfs", "-o", "size=1G", "-o", "mode=1777", "tmpfs", "/mnt/chroot dir/proc"},
+		},
+	}
+
+	for _, c := range cases {
+		if actual := chrootMountArgs(c.mountInfo, "/mnt/chroot dir/proc"); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%v: expected %#v, got %#v", c.mountInfo, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+type partitionMountData struct {
+	Device string
+}
+
+type partitionMount struct {
+	Device  string
+	Path    string
+	Options []string
+}
+
+// StepMountPartitions mounts the additional partitions of the image, such
+// as /boot or /usr, within the chroot.
+type StepMountPartitions struct {
+	mountPaths []string
+}
+
+func (s *StepMountPartitions) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	mountPath := state.Get("mount_path").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	s.mountPaths = []string{}
+	state.Put("mount_partitions_cleanup", s)
+
+	if len(config.PartitionMounts) == 0 && len(config.BtrfsSubvolumes) == 0 && !config.MountFstab {
+		return multistep.ActionContinue
+	}
+
+	mounts, err := s.resolveMounts(state)
+	if err != nil {
+		return halt(state, err)
+	}
+
+	if len(mounts) == 0 {
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Mounting additional partitions within the chroot...")
+	for _, m := range mounts {
+		// The path is resolved after its parents are mounted, so that the
+		// symlinks in the image never lead to the host.
+		p, err := chrootPath(mountPath, m.Path)
+		if err != nil {
+			err := fmt.Errorf("Error resolving mount path: %s", err)
+			return halt(state, err)
+		}
+
+		if err := makeDirAll(p, cmdWrapper); err != nil {
+			err := fmt.Errorf("Error creating mount directory: %s", err)
+			return halt(state, err)
+		}
+
+		ui.Message(fmt.Sprintf("Mounting: %s on %s", m.Device, m.Path))
+
+		args := []string{"mount"}
+		if len(m.Options) > 0 {
+			args = append(args, "-o", strings.Join(m.Options, ","))
+		}
+		args = append(args, m.Device, p)
+
+		cmd, err := NewWrappedCommand(args, cmdWrapper)
+		if err != nil {
+			err := fmt.Errorf("Error creating mount command: %s", err)
+			return halt(state, err)
+		}
+
+		log.Printf("Mount command: %s %#v", cmd.Path, cmd.Args)
+
+		cmd.Stderr = new(bytes.Buffer)
+		if err := cmd.Run(); err != nil {
+			err := fmt.Errorf("Error mounting partition: %s\n%s", err, cmd.Stderr)
+			return halt(state, err)
+		}
+
+		s.mountPaths = append(s.mountPaths, p)
+	}
+
+	return multistep.ActionContinue
+}
+
+// resolveMounts returns the partitions to mount from partition_mounts,
+// btrfs_subvolumes and the fstab of the image, ordered so that parent
+// directories come first.
+func (s *StepMountPartitions) resolveMounts(state multistep.StateBag) ([]partitionMount, error) {
+	config := state.Get("config").(*Config)
+	device := state.Get("device").(string)
+	mountPath := state.Get("mount_path").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	partitions, err := listPartitions(device, cmdWrapper)
+	if err != nil {
+		return nil, fmt.Errorf("Error inspecting partitions: %s", err)
+	}
+
+	mounts := map[string]partitionMount{}
+
+	if config.MountFstab {
+		fstabPath, err := chrootPath(mountPath, "/etc/fstab")
+		if err != nil {
+			return nil, fmt.Errorf("Error resolving fstab: %s", err)
+		}
+
+		f, err := os.Open(fstabPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening fstab: %s", err)
+		}
+		defer f.Close()
+
+		entries, err := parseFstab(f)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing fstab: %s", err)
+		}
+
+		for _, e := range entries {
+			partition, ok := resolvePartitionSpec(e.Spec, device, partitions)
+			if !ok {
+				log.Printf("Skipping fstab entry not found in the image: %s %s", e.Spec, e.File)
+				continue
+			}
+
+			mounts[e.File] = partitionMount{
+				Device:  partition,
+				Path:    e.File,
+				Options: e.Options,
+			}
+		}
+	}
+
+	// partition_mounts takes precedence over fstab.
+	ctx := config.ctx
+	ctx.Data = &partitionMountData{Device: device}
+
+	for spec, value := range config.PartitionMounts {
+		spec, err := interpolate.Render(spec, &ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Error interpolating partition_mounts: %s", err)
+		}
+
+		partition, ok := resolvePartitionSpec(spec, device, partitions)
+		if !ok {
+			return nil, fmt.Errorf("Partition not found: %s", spec)
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("Mount path is not specified for partition: %s", spec)
+		}
+
+		m := partitionMount{
+			Device: partition,
+			Path:   fields[0],
+		}
+		if len(fields) > 1 {
+			m.Options = strings.Split(fields[1], ",")
+		}
+
+		mounts[m.Path] = m
+	}
+
+	rootDevice := state.Get("root_device").(string)
+	for subvol, path := range config.BtrfsSubvolumes {
+		mounts[path] = partitionMount{
+			Device:  rootDevice,
+			Path:    path,
+			Options: []string{"subvol=" + subvol},
+		}
+	}
+
+	result := make([]partitionMount, 0, len(mounts))
+	for _, m := range mounts {
+		result = append(result, m)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return filepath.Clean(result[i].Path) < filepath.Clean(result[j].Path)
+	})
+
+	return result, nil
+}
+
+func (s *StepMountPartitions) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *StepMountPartitions) CleanupFunc(state multistep.StateBag) error {
+	ui := state.Get("ui").(packer.Ui)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if len(s.mountPaths) == 0 {
+		return nil
+	}
+
+	ui.Say("Unmounting additional partitions...")
+
+	for i := len(s.mountPaths) - 1; i >= 0; i-- {
+		cmd, err := NewWrappedCommand([]string{"umount", s.mountPaths[i]}, cmdWrapper)
+		if err != nil {
+			return fmt.Errorf("Error creating unmount command: %s", err)
+		}
+
+		cmd.Stderr = new(bytes.Buffer)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Error unmounting partition: %s\n%s", err, cmd.Stderr)
+		}
+
+		s.mountPaths = s.mountPaths[:i]
+	}
+
+	s.mountPaths = nil
+
+	return nil
+}
+
+// resolvePartitionSpec returns the device path of the partition specified
+// by a partition number, a device path, or a tag such as "LABEL=boot" as
+// used in fstab. A bare name is treated as a label.
+func resolvePartitionSpec(spec, device string, partitions []partitionInfo) (string, bool) {
+	if num, err := strconv.Atoi(spec); err == nil {
+		for _, p := range partitions {
+			if p.Number == num {
+				return p.Device, true
+			}
+		}
+		return "", false
+	}
+
+	if strings.HasPrefix(spec, "/dev/") {
+		for _, p := range partitions {
+			if p.Device == spec {
+				return p.Device, true
+			}
+		}
+		return "", false
+	}
+
+	kv := strings.SplitN(spec, "=", 2)
+	if len(kv) != 2 {
+		kv = []string{"LABEL", spec}
+	}
+
+	value := strings.Trim(kv[1], "\"")
+	for _, p := range partitions {
+		var match bool
+		switch strings.ToUpper(kv[0]) {
+		case "LABEL":
+			match = p.Label == value || p.PartLabel == value
+		case "UUID":
+			match = strings.EqualFold(p.UUID, value)
+		case "PARTUUID":
+			match = strings.EqualFold(p.PartUUID, value)
+		case "PARTLABEL":
+			match = p.PartLabel == value
+		}
+
+		if match {
+			return p.Device, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,133 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepOpenLUKS opens the LUKS-encrypted root partition and replaces the
+// root device with the decrypted mapper device.
+type StepOpenLUKS struct {
+	name string
+}
+
+func (s *StepOpenLUKS) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	rootDevice := state.Get("root_device").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	state.Put("luks_cleanup", s)
+
+	if config.LUKSPassphrase == "" && config.LUKSKeyFile == "" {
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Opening encrypted root partition...")
+
+	name := fmt.Sprintf("packer-%s-root", filepath.Base(device))
+
+	// The passphrase is given through stdin so that it never appears in
+	// the command line or the logs.
+	keyFile := "-"
+	if config.LUKSKeyFile != "" {
+		keyFile = config.LUKSKeyFile
+	}
+
+	// Discard requests are passed through to the image so that the
+	// filesystem can be sparsified.
+	opts := ""
+	if config.Sparsify {
+		opts = " --allow-discards"
+	}
+
+	cmd := fmt.Sprintf("cryptsetup open --type luks%s --key-file=%s %s %s", opts, keyFile, rootDevice, name)
+	if err := runCryptsetupCommand(cmd, config, cmdWrapper); err != nil {
+		err := fmt.Errorf("Error opening encrypted partition: %s", err)
+		return halt(state, err)
+	}
+
+	s.name = name
+
+	mapperDevice := filepath.Join("/dev/mapper", name)
+	ui.Message(fmt.Sprintf("Decrypted device: %s", mapperDevice))
+
+	// The encrypted partition has been grown, so grow the decrypted device
+	// before its filesystem is grown. LUKS2 may require the key to resize.
+	if config.DiskSize != "" && !config.FromScratch {
+		ui.Message("Resizing decrypted device...")
+
+		cmd := fmt.Sprintf("cryptsetup resize --key-file=%s %s", keyFile, name)
+		if err := runCryptsetupCommand(cmd, config, cmdWrapper); err != nil {
+			err := fmt.Errorf("Error resizing encrypted partition: %s", err)
+			return halt(state, err)
+		}
+	}
+
+	state.Put("luks_device", mapperDevice)
+	state.Put("root_device", mapperDevice)
+
+	return multistep.ActionContinue
+}
+
+// runCryptsetupCommand runs the cryptsetup command with the passphrase given
+// through stdin unless the key file is used.
+func runCryptsetupCommand(command string, config *Config, cmdWrapper CommandWrapper) error {
+	cmd, err := cmdWrapper(command)
+	if err != nil {
+		return fmt.Errorf("Error creating cryptsetup command: %s", err)
+	}
+
+	log.Printf("Cryptsetup command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	if config.LUKSKeyFile == "" {
+		shell.Stdin = strings.NewReader(config.LUKSPassphrase)
+	}
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("%s\n%s", err, shell.Stderr)
+	}
+
+	return nil
+}
+
+func (s *StepOpenLUKS) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *StepOpenLUKS) CleanupFunc(state multistep.StateBag) error {
+	ui := state.Get("ui").(packer.Ui)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if s.name == "" {
+		return nil
+	}
+
+	ui.Say("Closing encrypted root partition...")
+	cmd, err := cmdWrapper(fmt.Sprintf("cryptsetup close %s", s.name))
+	if err != nil {
+		return fmt.Errorf("Error creating cryptsetup command: %s", err)
+	}
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("Error closing encrypted partition: %s\n%s", err, shell.Stderr)
+	}
+
+	s.name = ""
+
+	return nil
+}
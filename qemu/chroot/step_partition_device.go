@@ -0,0 +1,166 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// partitionTypes maps the partition type to the sfdisk type alias, which is
+// available for both GPT and MBR partition tables.
+var partitionTypes = map[string]string{
+	"esp":   "U",
+	"boot":  "L",
+	"root":  "L",
+	"linux": "L",
+	"swap":  "S",
+}
+
+// defaultFilesystems maps the partition type to its default filesystem.
+var defaultFilesystems = map[string]string{
+	"esp":   "vfat",
+	"boot":  "ext4",
+	"root":  "ext4",
+	"linux": "ext4",
+	"swap":  "swap",
+}
+
+// StepPartitionDevice creates partitions and filesystems on the device
+// when building from scratch.
+type StepPartitionDevice struct{}
+
+func (s *StepPartitionDevice) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if !config.FromScratch {
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Creating partitions...")
+
+	script := partitionScript(config.PartitionTable, config.Partitions)
+	log.Printf("Partition script:\n%s", script)
+
+	cmd, err := cmdWrapper(fmt.Sprintf("sfdisk %s", device))
+	if err != nil {
+		err := fmt.Errorf("Error creating partition command: %s", err)
+		return halt(state, err)
+	}
+
+	log.Printf("Partition command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stdin = strings.NewReader(script)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		err := fmt.Errorf("Error creating partitions: %s\n%s", err, shell.Stderr)
+		return halt(state, err)
+	}
+
+	if err := settleDevice(device, config, cmdWrapper); err != nil {
+		err := fmt.Errorf("Error settling device: %s", err)
+		return halt(state, err)
+	}
+
+	nums := make([]int, 0, len(config.Partitions))
+	for i := range config.Partitions {
+		nums = append(nums, i+1)
+	}
+
+	if err := waitForPartitions(device, nums, config.deviceTimeout); err != nil {
+		err := fmt.Errorf("Error waiting for partitions to appear: %s", err)
+		return halt(state, err)
+	}
+
+	ui.Say("Creating filesystems...")
+	for i, p := range config.Partitions {
+		partition := fmt.Sprintf("%sp%d", device, i+1)
+
+		cmd := mkfsCommand(p, partition)
+		if cmd == "" {
+			continue
+		}
+
+		ui.Message(fmt.Sprintf("Creating %s filesystem: %s", p.Filesystem, partition))
+
+		cmd, err := cmdWrapper(cmd)
+		if err != nil {
+			err := fmt.Errorf("Error creating mkfs command: %s", err)
+			return halt(state, err)
+		}
+
+		log.Printf("Mkfs command: %s", cmd)
+
+		shell := NewShellCommand(cmd)
+		shell.Stderr = new(bytes.Buffer)
+		if err := shell.Run(); err != nil {
+			err := fmt.Errorf("Error creating filesystem: %s\n%s", err, shell.Stderr)
+			return halt(state, err)
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepPartitionDevice) Cleanup(state multistep.StateBag) {}
+
+// partitionScript returns the sfdisk script for given partitions.
+func partitionScript(table string, partitions []PartitionConfig) string {
+	label := "gpt"
+	if table == "mbr" {
+		label = "dos"
+	}
+
+	lines := []string{fmt.Sprintf("label: %s", label)}
+	for _, p := range partitions {
+		fields := []string{}
+		if p.Size != "" {
+			fields = append(fields, fmt.Sprintf("size=%s", p.Size))
+		}
+
+		fields = append(fields, fmt.Sprintf("type=%s", partitionTypes[p.Type]))
+
+		if label == "gpt" && p.Name != "" {
+			fields = append(fields, fmt.Sprintf("name=\"%s\"", p.Name))
+		}
+
+		if label == "dos" && p.Type == "boot" {
+			fields = append(fields, "bootable")
+		}
+
+		lines = append(lines, strings.Join(fields, ", "))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// mkfsCommand returns the command to create the filesystem of the partition.
+func mkfsCommand(p PartitionConfig, partition string) string {
+	switch p.Filesystem {
+	case "none":
+		return ""
+	case "swap":
+		if p.Label != "" {
+			return fmt.Sprintf("mkswap -L %s %s", p.Label, partition)
+		}
+		return fmt.Sprintf("mkswap %s", partition)
+	case "vfat":
+		if p.Label != "" {
+			return fmt.Sprintf("mkfs.vfat -n %s %s", p.Label, partition)
+		}
+		return fmt.Sprintf("mkfs.vfat %s", partition)
+	default:
+		if p.Label != "" {
+			return fmt.Sprintf("mkfs.%s -L %s %s", p.Filesystem, p.Label, partition)
+		}
+		return fmt.Sprintf("mkfs.%s %s", p.Filesystem, partition)
+	}
+}
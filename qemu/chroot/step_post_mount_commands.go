@@ -0,0 +1,44 @@
+package chroot
+
+import (
+	"context"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+type postMountCommandsData struct {
+	Device    string
+	MountPath string
+}
+
+// StepPostMountCommands runs commands after the device is mounted and
+// before the extra paths are mounted.
+type StepPostMountCommands struct{}
+
+func (s *StepPostMountCommands) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	mountPath := state.Get("mount_path").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if len(config.PostMountCommands) == 0 {
+		return multistep.ActionContinue
+	}
+
+	ctx := config.ctx
+	ctx.Data = &postMountCommandsData{
+		Device:    device,
+		MountPath: mountPath,
+	}
+
+	ui.Say("Running post-mount commands...")
+	if err := RunLocalCommands(config.PostMountCommands, cmdWrapper, ctx, ui); err != nil {
+		return halt(state, err)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepPostMountCommands) Cleanup(state multistep.StateBag) {}
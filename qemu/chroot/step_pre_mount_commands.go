@@ -0,0 +1,39 @@
+package chroot
+
+import (
+	"context"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+type preMountCommandsData struct {
+	Device string
+}
+
+// StepPreMountCommands runs commands after the device is connected and
+// before it is mounted.
+type StepPreMountCommands struct{}
+
+func (s *StepPreMountCommands) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if len(config.PreMountCommands) == 0 {
+		return multistep.ActionContinue
+	}
+
+	ctx := config.ctx
+	ctx.Data = &preMountCommandsData{Device: device}
+
+	ui.Say("Running pre-mount commands...")
+	if err := RunLocalCommands(config.PreMountCommands, cmdWrapper, ctx, ui); err != nil {
+		return halt(state, err)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepPreMountCommands) Cleanup(state multistep.StateBag) {}
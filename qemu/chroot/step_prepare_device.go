@@ -7,6 +7,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/hashicorp/packer/helper/multistep"
 	"github.com/hashicorp/packer/packer"
@@ -16,26 +19,44 @@ const (
 	devicePrefix string = "nbd"
 )
 
-type StepPrepareDevice struct{}
+type StepPrepareDevice struct {
+	lock  *deviceLock
+	tried map[string]bool
+}
 
 func (s *StepPrepareDevice) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
 	config := state.Get("config").(*Config)
 	ui := state.Get("ui").(packer.Ui)
 
+	// Other backends allocate the device when attaching the image.
+	if config.DeviceBackend != deviceBackendNBD {
+		return multistep.ActionContinue
+	}
+
 	ui.Say("Finding available device...")
 
+	s.tried = map[string]bool{}
+
 	devicePath := config.DevicePath
 	if devicePath == "" {
 		var err error
 
 		log.Println("Device path not specified, searching for available device...")
 
-		devicePath, err = findAvailableDevice()
+		devicePath, err = s.allocate()
 		if err != nil {
 			err := fmt.Errorf("Error finding available device: %s", err)
 			return halt(state, err)
 		}
 	} else {
+		lock, err := lockDevice(devicePath)
+		if err != nil {
+			err := fmt.Errorf("Device is locked by another build: %s", devicePath)
+			return halt(state, err)
+		}
+
+		s.lock = lock
+
 		if !isAvailable(devicePath) {
 			err := fmt.Errorf("Device is not available: %s", devicePath)
 			return halt(state, err)
@@ -44,30 +65,113 @@ func (s *StepPrepareDevice) Run(_ context.Context, state multistep.StateBag) mul
 
 	log.Printf("Device: %s", devicePath)
 	state.Put("device", devicePath)
+	state.Put("device_allocator", s)
 
 	return multistep.ActionContinue
 }
 
-func (s *StepPrepareDevice) Cleanup(state multistep.StateBag) {}
+func (s *StepPrepareDevice) Cleanup(state multistep.StateBag) {
+	s.release()
+}
+
+// Reallocate releases the current device and allocates another available
+// device. This is used when connecting to the allocated device failed.
+func (s *StepPrepareDevice) Reallocate(state multistep.StateBag) (string, error) {
+	config := state.Get("config").(*Config)
 
-func findAvailableDevice() (string, error) {
-	for i := 0; i < 10; i++ {
-		device := fmt.Sprintf("%s%d", devicePrefix, i)
+	if config.DevicePath != "" {
+		return "", errors.New("device_path is specified")
+	}
+
+	s.release()
+
+	devicePath, err := s.allocate()
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Device: %s", devicePath)
+	state.Put("device", devicePath)
+
+	return devicePath, nil
+}
+
+// allocate finds an available device which has not been tried yet and
+// locks it.
+func (s *StepPrepareDevice) allocate() (string, error) {
+	devices, err := listDevices()
+	if err != nil {
+		return "", err
+	}
+
+	for _, devicePath := range devices {
+		if s.tried[devicePath] {
+			continue
+		}
+		s.tried[devicePath] = true
 
-		devicePath := fmt.Sprintf("/dev/%s", device)
-		_, err := os.Stat(devicePath)
+		lock, err := lockDevice(devicePath)
 		if err != nil {
+			log.Printf("Device is locked: %s: %s", devicePath, err)
 			continue
 		}
 
-		if isAvailable(device) {
-			return devicePath, nil
+		if !isAvailable(devicePath) {
+			lock.Unlock()
+			continue
 		}
+
+		s.lock = lock
+		return devicePath, nil
 	}
 
 	return "", errors.New("available device could not be found")
 }
 
+func (s *StepPrepareDevice) release() {
+	if s.lock == nil {
+		return
+	}
+
+	if err := s.lock.Unlock(); err != nil {
+		log.Printf("Error unlocking device: %s", err)
+	}
+
+	s.lock = nil
+}
+
+// listDevices returns the paths of all network block devices in the order
+// of their number.
+func listDevices() ([]string, error) {
+	paths, err := filepath.Glob(fmt.Sprintf("/sys/block/%s*", devicePrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	nums := []int{}
+	for _, p := range paths {
+		num, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(p), devicePrefix))
+		if err != nil {
+			continue
+		}
+
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	devices := []string{}
+	for _, num := range nums {
+		devicePath := fmt.Sprintf("/dev/%s%d", devicePrefix, num)
+		if _, err := os.Stat(devicePath); err != nil {
+			continue
+		}
+
+		devices = append(devices, devicePath)
+	}
+
+	return devices, nil
+}
+
 func isAvailable(devicePath string) bool {
 	device := filepath.Base(devicePath)
 	pidPath := fmt.Sprintf("/sys/block/%s/pid", device)
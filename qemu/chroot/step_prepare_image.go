@@ -1,6 +1,7 @@
 package chroot
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -13,14 +14,29 @@ import (
 )
 
 type StepPrepareImage struct {
-	imagePath string
+	imagePath     string
+	tmpSourcePath string
 }
 
 func (s *StepPrepareImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
 	config := state.Get("config").(*Config)
 	ui := state.Get("ui").(packer.Ui)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
 
-	sourcePath, err := filepath.Abs(config.SourceImage)
+	if config.FromScratch {
+		imagePath := filepath.Join(config.OutputDir, config.ImageName)
+		if err := s.createBlankImage(state, imagePath); err != nil {
+			return halt(state, err)
+		}
+
+		s.imagePath = imagePath
+		state.Put("image_path", imagePath)
+		state.Put("image_format", "qcow2")
+
+		return multistep.ActionContinue
+	}
+
+	sourcePath, err := filepath.Abs(state.Get("source_image_path").(string))
 	if err != nil {
 		err := fmt.Errorf("Error checking source image: %s", err)
 		return halt(state, err)
@@ -32,37 +48,193 @@ func (s *StepPrepareImage) Run(_ context.Context, state multistep.StateBag) mult
 	}
 
 	log.Printf("Source image path: %s", sourcePath)
+
+	imagePath := filepath.Join(config.OutputDir, config.ImageName)
+
+	compression, err := detectCompression(sourcePath)
+	if err != nil {
+		err := fmt.Errorf("Error detecting compression of source image: %s", err)
+		return halt(state, err)
+	}
+
+	if compression != compressionNone {
+		ui.Say(fmt.Sprintf("Decompressing source image (%s)...", compression))
+
+		tmpPath, err := filepath.Abs(imagePath + ".source")
+		if err != nil {
+			err := fmt.Errorf("Error preparing decompressed image path: %s", err)
+			return halt(state, err)
+		}
+
+		s.tmpSourcePath = tmpPath
+		if err := decompressImage(sourcePath, tmpPath, compression); err != nil {
+			err := fmt.Errorf("Error decompressing source image: %s", err)
+			return halt(state, err)
+		}
+
+		sourcePath = tmpPath
+	}
+
+	format := config.SourceFormat
+	if format == "" {
+		info, err := inspectImage(sourcePath, cmdWrapper)
+		if err != nil {
+			err := fmt.Errorf("Error detecting format of source image: %s", err)
+			return halt(state, err)
+		}
+
+		format = info.Format
+	}
+
+	log.Printf("Source image format: %s", format)
+
+	switch {
+	case config.UseBackingFile:
+		err = s.createOverlay(state, sourcePath, format, imagePath)
+	case format == "qcow2" && s.tmpSourcePath != "":
+		// The decompressed image can be used as it is.
+		err = os.Rename(sourcePath, imagePath)
+		s.tmpSourcePath = ""
+	case format == "qcow2":
+		err = s.copyImage(state, sourcePath, imagePath)
+	default:
+		err = s.convertImage(state, sourcePath, format, imagePath)
+	}
+	if err != nil {
+		return halt(state, err)
+	}
+
+	// The decompressed source image is kept as the backing file of the
+	// resulting image, so it is a part of the artifact.
+	if config.KeepBackingFile && s.tmpSourcePath != "" {
+		state.Put("backing_file_path", s.tmpSourcePath)
+	}
+
+	s.imagePath = imagePath
+	state.Put("source_path", sourcePath)
+	state.Put("source_format", format)
+	state.Put("image_path", imagePath)
+	state.Put("image_format", "qcow2")
+
+	return multistep.ActionContinue
+}
+
+func (s *StepPrepareImage) Cleanup(state multistep.StateBag) {
+	config := state.Get("config").(*Config)
+
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+
+	// The decompressed source image is still referred by the resulting
+	// image as its backing file unless the build failed.
+	if s.tmpSourcePath == "" || (config.KeepBackingFile && !cancelled && !halted) {
+		return
+	}
+
+	log.Printf("Removing decompressed source image: %s", s.tmpSourcePath)
+	if err := os.Remove(s.tmpSourcePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing decompressed source image: %s", err)
+	}
+
+	s.tmpSourcePath = ""
+}
+
+func (s *StepPrepareImage) copyImage(state multistep.StateBag, sourcePath, imagePath string) error {
+	ui := state.Get("ui").(packer.Ui)
+
 	ui.Say("Copying source image...")
 
 	sourceFile, err := os.Open(sourcePath)
 	if err != nil {
-		err := fmt.Errorf("Error opening source image file: %s", err)
-		return halt(state, err)
+		return fmt.Errorf("Error opening source image file: %s", err)
 	}
+	defer sourceFile.Close()
 
-	imagePath := filepath.Join(config.OutputDir, config.ImageName)
 	imageFile, err := os.OpenFile(imagePath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		err := fmt.Errorf("Error opening image file: %s", err)
-		return halt(state, err)
+		return fmt.Errorf("Error opening image file: %s", err)
 	}
+	defer imageFile.Close()
 
 	_, err = io.Copy(imageFile, sourceFile)
 	if err != nil {
-		err := fmt.Errorf("Error copying source image file: %s", err)
-		return halt(state, err)
+		return fmt.Errorf("Error copying source image file: %s", err)
 	}
 
 	err = imageFile.Sync()
 	if err != nil {
-		err := fmt.Errorf("Error syncing image file: %s", err)
-		return halt(state, err)
+		return fmt.Errorf("Error syncing image file: %s", err)
 	}
 
-	s.imagePath = imageFile.Name()
-	state.Put("image_path", imageFile.Name())
+	return nil
+}
 
-	return multistep.ActionContinue
+func (s *StepPrepareImage) createBlankImage(state multistep.StateBag, imagePath string) error {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	ui.Say(fmt.Sprintf("Creating blank image (%s)...", config.DiskSize))
+
+	cmd := fmt.Sprintf("qemu-img create -f qcow2 %s %s", imagePath, config.DiskSize)
+	cmd, err := cmdWrapper(cmd)
+	if err != nil {
+		return fmt.Errorf("Error creating image creation command: %s", err)
+	}
+
+	log.Printf("Image creation command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("Error creating blank image: %s\n%s", err, shell.Stderr)
+	}
+
+	return nil
+}
+
+func (s *StepPrepareImage) convertImage(state multistep.StateBag, sourcePath, format, imagePath string) error {
+	ui := state.Get("ui").(packer.Ui)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	ui.Say(fmt.Sprintf("Converting source image from %s to qcow2...", format))
+
+	cmd := fmt.Sprintf("qemu-img convert -f %s -O qcow2 %s %s", format, sourcePath, imagePath)
+	cmd, err := cmdWrapper(cmd)
+	if err != nil {
+		return fmt.Errorf("Error creating conversion command: %s", err)
+	}
+
+	log.Printf("Conversion command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("Error converting source image: %s\n%s", err, shell.Stderr)
+	}
+
+	return nil
 }
 
-func (s *StepPrepareImage) Cleanup(state multistep.StateBag) {}
+func (s *StepPrepareImage) createOverlay(state multistep.StateBag, sourcePath, format, imagePath string) error {
+	ui := state.Get("ui").(packer.Ui)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	ui.Say("Creating overlay image backed by source image...")
+
+	cmd := fmt.Sprintf("qemu-img create -f qcow2 -F %s -b %s %s", format, sourcePath, imagePath)
+	cmd, err := cmdWrapper(cmd)
+	if err != nil {
+		return fmt.Errorf("Error creating overlay command: %s", err)
+	}
+
+	log.Printf("Overlay command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		return fmt.Errorf("Error creating overlay image: %s\n%s", err, shell.Stderr)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package chroot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// policyRcD is the policy-rc.d script which denies invoke-rc.d and
+// deb-systemd-invoke to start services.
+const policyRcD = `#!/bin/sh
+# Installed by packer-builder-qemu-chroot to prevent services from starting.
+exit 101
+`
+
+// policyRcDPath is the path of policy-rc.d within the chroot.
+const policyRcDPath = "/usr/sbin/policy-rc.d"
+
+// systemdRuntimePath is the directory which tells that systemd is the init
+// system. With it, service and the init scripts of RPM-based distributions
+// redirect to systemctl, which ignores start and stop requests within the
+// chroot or in offline mode instead of running the daemons directly.
+const systemdRuntimePath = "/run/systemd/system"
+
+// StepPreventServiceStart installs policy-rc.d within the chroot and
+// creates the systemd runtime directory so that package scripts do not
+// start services during provisioning. The existing policy-rc.d in the
+// image is restored and the created directories are removed in cleanup.
+type StepPreventServiceStart struct {
+	path   string
+	backup string
+	dirs   []string
+}
+
+func (s *StepPreventServiceStart) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	mountPath := state.Get("mount_path").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	s.path = ""
+	s.backup = ""
+	s.dirs = nil
+	state.Put("prevent_service_start_cleanup", s)
+
+	if !config.PreventServiceStart {
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Preventing services from starting within the chroot...")
+
+	// The paths are resolved within the chroot so that the symlinks in the
+	// image never lead to the host. A symlink at policy-rc.d itself is
+	// moved aside rather than followed.
+	dir, err := chrootPath(mountPath, filepath.Dir(policyRcDPath))
+	if err != nil {
+		err := fmt.Errorf("Error resolving policy-rc.d directory: %s", err)
+		return halt(state, err)
+	}
+
+	dst := filepath.Join(dir, filepath.Base(policyRcDPath))
+	exists, err := fileExists(dst, cmdWrapper)
+	if err != nil {
+		err := fmt.Errorf("Error checking existing policy-rc.d: %s", err)
+		return halt(state, err)
+	}
+
+	if exists {
+		backup := dst + ".packer-orig"
+		log.Printf("Moving existing policy-rc.d to %s", backup)
+
+		if err := renameFile(dst, backup, cmdWrapper); err != nil {
+			err := fmt.Errorf("Error moving existing policy-rc.d: %s", err)
+			return halt(state, err)
+		}
+
+		s.backup = backup
+	}
+
+	// Record the path before installing it so that it is removed even if
+	// installing fails halfway.
+	s.path = dst
+
+	ui.Message(fmt.Sprintf("Installing: %s", policyRcDPath))
+
+	if err := makeDirAll(filepath.Dir(dst), cmdWrapper); err != nil {
+		err := fmt.Errorf("Error creating policy-rc.d directory: %s", err)
+		return halt(state, err)
+	}
+
+	if err := writeFileTo(dst, strings.NewReader(policyRcD), newFileAttrs(0755), cmdWrapper); err != nil {
+		err := fmt.Errorf("Error installing policy-rc.d: %s", err)
+		return halt(state, err)
+	}
+
+	// systemd-nspawn mounts its own /run.
+	if config.ExecutionMode == executionModeNspawn {
+		return multistep.ActionContinue
+	}
+
+	// Record the directories to create, deepest first, so that only they
+	// are removed in cleanup.
+	dir, err = chrootPath(mountPath, systemdRuntimePath)
+	if err != nil {
+		err := fmt.Errorf("Error resolving systemd runtime directory: %s", err)
+		return halt(state, err)
+	}
+
+	for p := dir; p != filepath.Clean(mountPath); p = filepath.Dir(p) {
+		exists, err := fileExists(p, cmdWrapper)
+		if err != nil {
+			err := fmt.Errorf("Error checking systemd runtime directory: %s", err)
+			return halt(state, err)
+		}
+
+		if exists {
+			break
+		}
+		s.dirs = append(s.dirs, p)
+	}
+
+	if len(s.dirs) == 0 {
+		return multistep.ActionContinue
+	}
+
+	ui.Message(fmt.Sprintf("Creating: %s", systemdRuntimePath))
+
+	if err := makeDirAll(dir, cmdWrapper); err != nil {
+		err := fmt.Errorf("Error creating systemd runtime directory: %s", err)
+		return halt(state, err)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepPreventServiceStart) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *StepPreventServiceStart) CleanupFunc(state multistep.StateBag) error {
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	for len(s.dirs) > 0 {
+		log.Printf("Removing systemd runtime directory: %s", s.dirs[0])
+
+		if err := removeDir(s.dirs[0], cmdWrapper); err != nil {
+			return fmt.Errorf("Error removing systemd runtime directory: %s", err)
+		}
+
+		s.dirs = s.dirs[1:]
+	}
+
+	if s.path != "" {
+		log.Printf("Removing policy-rc.d: %s", s.path)
+
+		if err := removeFile(s.path, cmdWrapper); err != nil {
+			return fmt.Errorf("Error removing policy-rc.d: %s", err)
+		}
+
+		s.path = ""
+	}
+
+	if s.backup != "" {
+		dst := strings.TrimSuffix(s.backup, ".packer-orig")
+		log.Printf("Restoring policy-rc.d: %s", dst)
+
+		if err := renameFile(s.backup, dst, cmdWrapper); err != nil {
+			return fmt.Errorf("Error restoring policy-rc.d: %s", err)
+		}
+
+		s.backup = ""
+	}
+
+	return nil
+}
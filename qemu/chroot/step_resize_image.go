@@ -0,0 +1,48 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepResizeImage grows the image to disk_size.
+type StepResizeImage struct{}
+
+func (s *StepResizeImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	imagePath := state.Get("image_path").(string)
+	imageFormat := state.Get("image_format").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if config.DiskSize == "" || config.FromScratch {
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Resizing image to %s...", config.DiskSize))
+
+	cmd := fmt.Sprintf("qemu-img resize -f %s %s %s", imageFormat, imagePath, config.DiskSize)
+	cmd, err := cmdWrapper(cmd)
+	if err != nil {
+		err := fmt.Errorf("Error creating resize command: %s", err)
+		return halt(state, err)
+	}
+
+	log.Printf("Resize command: %s", cmd)
+
+	shell := NewShellCommand(cmd)
+	shell.Stderr = new(bytes.Buffer)
+	if err := shell.Run(); err != nil {
+		err := fmt.Errorf("Error resizing image: %s\n%s", err, shell.Stderr)
+		return halt(state, err)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepResizeImage) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,146 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepResolvePartition determines the partition containing the root
+// filesystem.
+type StepResolvePartition struct{}
+
+func (s *StepResolvePartition) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	num := config.MountPartition
+	if num == 0 {
+		ui.Say("Finding root partition...")
+
+		partitions, err := listPartitions(device, cmdWrapper)
+		if err != nil {
+			err := fmt.Errorf("Error inspecting partitions: %s", err)
+			return halt(state, err)
+		}
+
+		p, err := s.find(state, partitions)
+		if err != nil {
+			err := fmt.Errorf("Error finding root partition: %s", err)
+			return halt(state, err)
+		}
+
+		num = p.Number
+	}
+
+	rootDevice := fmt.Sprintf("%sp%d", device, num)
+	ui.Message(fmt.Sprintf("Root partition: %s", rootDevice))
+
+	state.Put("root_partition", num)
+	state.Put("root_device", rootDevice)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepResolvePartition) Cleanup(state multistep.StateBag) {}
+
+// find returns the partition which matches all of the configured criteria.
+func (s *StepResolvePartition) find(state multistep.StateBag, partitions []partitionInfo) (*partitionInfo, error) {
+	config := state.Get("config").(*Config)
+
+	candidates := []partitionInfo{}
+	for _, p := range partitions {
+		if config.RootPartitionLabel != "" && p.Label != config.RootPartitionLabel && p.PartLabel != config.RootPartitionLabel {
+			continue
+		}
+
+		if config.RootPartitionUUID != "" && !strings.EqualFold(p.UUID, config.RootPartitionUUID) && !strings.EqualFold(p.PartUUID, config.RootPartitionUUID) {
+			continue
+		}
+
+		if config.RootPartitionFSType != "" && p.Filesystem != config.RootPartitionFSType {
+			continue
+		}
+
+		if p.Filesystem == "" || p.Filesystem == "swap" {
+			continue
+		}
+
+		if config.DetectRootPartition {
+			// A partition left mounted must not be skipped silently.
+			found, err := s.hasOSRelease(state, p.Device)
+			if err != nil {
+				return nil, fmt.Errorf("Error inspecting partition %s: %s", p.Device, err)
+			}
+
+			if !found {
+				continue
+			}
+		}
+
+		candidates = append(candidates, p)
+	}
+
+	if len(candidates) == 0 {
+		return nil, errors.New("no partition matched")
+	}
+
+	if len(candidates) > 1 {
+		log.Printf("%d partitions matched, using the first one", len(candidates))
+	}
+
+	return &candidates[0], nil
+}
+
+// hasOSRelease mounts the partition read-only in a temporary directory and
+// checks whether it contains os-release file. The partition which cannot
+// be mounted does not contain it. The partition is always unmounted, and
+// the error is returned only if unmounting fails.
+func (s *StepResolvePartition) hasOSRelease(state multistep.StateBag, partition string) (found bool, err error) {
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	dir, err := ioutil.TempDir("", "packer-builder-qemu-chroot")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(dir)
+
+	cmd, err := NewWrappedCommand([]string{"mount", "-o", "ro", partition, dir}, cmdWrapper)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Mount command: %s %#v", cmd.Path, cmd.Args)
+
+	cmd.Stderr = new(bytes.Buffer)
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error mounting partition %s: %s\n%s", partition, err, cmd.Stderr)
+		return false, nil
+	}
+
+	// The temporary directory is removed after unmounting.
+	defer func() {
+		cmd, uerr := NewWrappedCommand([]string{"umount", dir}, cmdWrapper)
+		if uerr != nil {
+			found, err = false, uerr
+			return
+		}
+
+		cmd.Stderr = new(bytes.Buffer)
+		if uerr := cmd.Run(); uerr != nil {
+			found, err = false, fmt.Errorf("Error unmounting %s: %s\n%s", dir, uerr, cmd.Stderr)
+		}
+	}()
+
+	return hasOSRelease(dir), nil
+}
@@ -0,0 +1,126 @@
+package chroot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepSetupEmulation registers the qemu-user-static binfmt_misc handler of
+// target_arch and copies the interpreter into the chroot, so that the
+// binaries of another architecture can be run within the chroot.
+type StepSetupEmulation struct {
+	interpreter string
+}
+
+func (s *StepSetupEmulation) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	mountPath := state.Get("mount_path").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	s.interpreter = ""
+	state.Put("emulation_cleanup", s)
+
+	if config.TargetArch == "" {
+		return multistep.ActionContinue
+	}
+
+	arch, _ := findEmulatedArch(config.TargetArch)
+	if arch.isNative() {
+		log.Printf("Target architecture %s is native, skipping emulation", arch.Name)
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Setting up emulation for %s...", arch.Name))
+
+	enabled, interpreter, err := binfmtHandler(arch.handlerName())
+	if err != nil {
+		err := fmt.Errorf("Error reading binfmt_misc handler: %s", err)
+		return halt(state, err)
+	}
+
+	if interpreter == "" {
+		interpreter, err = findInterpreter(arch)
+		if err != nil {
+			err := fmt.Errorf("Error finding interpreter: %s", err)
+			return halt(state, err)
+		}
+
+		ui.Message(fmt.Sprintf("Registering binfmt_misc handler: %s", arch.handlerName()))
+		if err := registerBinfmtHandler(arch, interpreter, cmdWrapper); err != nil {
+			err := fmt.Errorf("Error registering binfmt_misc handler: %s", err)
+			return halt(state, err)
+		}
+	} else if !enabled {
+		err := fmt.Errorf("binfmt_misc handler %s is registered but disabled", arch.handlerName())
+		return halt(state, err)
+	}
+
+	ui.Message(fmt.Sprintf("Interpreter: %s", interpreter))
+
+	// The interpreter is looked up within the chroot unless the handler is
+	// registered with the fix-binary flag, so copy it to the same path. The
+	// directory is resolved within the chroot so that the symlinks in the
+	// image never lead to the host.
+	destDir, err := chrootPath(mountPath, filepath.Dir(interpreter))
+	if err != nil {
+		err := fmt.Errorf("Error resolving interpreter directory: %s", err)
+		return halt(state, err)
+	}
+
+	destPath := filepath.Join(destDir, filepath.Base(interpreter))
+	exists, err := fileExists(destPath, cmdWrapper)
+	if err != nil {
+		err := fmt.Errorf("Error checking interpreter in the chroot: %s", err)
+		return halt(state, err)
+	}
+
+	if exists {
+		log.Printf("Interpreter already exists in the chroot: %s", interpreter)
+		return multistep.ActionContinue
+	}
+
+	if err := makeDirAll(destDir, cmdWrapper); err != nil {
+		err := fmt.Errorf("Error creating interpreter directory: %s", err)
+		return halt(state, err)
+	}
+
+	if err := copyFileTo(interpreter, destPath, cmdWrapper); err != nil {
+		err := fmt.Errorf("Error copying interpreter: %s", err)
+		return halt(state, err)
+	}
+
+	s.interpreter = destPath
+
+	return multistep.ActionContinue
+}
+
+func (s *StepSetupEmulation) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *StepSetupEmulation) CleanupFunc(state multistep.StateBag) error {
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if s.interpreter == "" {
+		return nil
+	}
+
+	log.Printf("Removing interpreter: %s", s.interpreter)
+
+	if err := removeFile(s.interpreter, cmdWrapper); err != nil {
+		return fmt.Errorf("Error removing interpreter: %s", err)
+	}
+
+	s.interpreter = ""
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package chroot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepSparsifyImage discards the unused blocks of the filesystems in the
+// image so that they are not stored in the resulting image.
+type StepSparsifyImage struct{}
+
+func (s *StepSparsifyImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	mountPath := state.Get("mount_path").(string)
+	imagePath := state.Get("image_path").(string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	if !config.Sparsify {
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Sparsifying image...")
+
+	before, err := allocatedSize(imagePath)
+	if err != nil {
+		err := fmt.Errorf("Error checking image size: %s", err)
+		return halt(state, err)
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		err := fmt.Errorf("Error reading mounts: %s", err)
+		return halt(state, err)
+	}
+
+	for _, m := range mounts {
+		if m.Target != mountPath && !strings.HasPrefix(m.Target, mountPath+"/") {
+			continue
+		}
+
+		// ZFS datasets are trimmed with the pool below.
+		if !strings.HasPrefix(m.Source, "/dev/") || !isDeviceOf(m.Source, device) {
+			continue
+		}
+
+		ui.Message(fmt.Sprintf("Trimming: %s", m.Target))
+
+		cmd, err := cmdWrapper(fmt.Sprintf("fstrim '%s'", m.Target))
+		if err != nil {
+			err := fmt.Errorf("Error creating fstrim command: %s", err)
+			return halt(state, err)
+		}
+
+		log.Printf("Fstrim command: %s", cmd)
+
+		shell := NewShellCommand(cmd)
+		shell.Stderr = new(bytes.Buffer)
+		if err := shell.Run(); err != nil {
+			// Not all filesystems support discard, so this is not fatal.
+			ui.Message(fmt.Sprintf("Failed to trim %s: %s", m.Target, strings.TrimSpace(fmt.Sprint(shell.Stderr))))
+		}
+	}
+
+	if pool, ok := state.GetOk("zfs_pool"); ok {
+		ui.Message(fmt.Sprintf("Trimming ZFS pool: %s", pool))
+
+		if _, err := runZFSCommand(fmt.Sprintf("zpool trim -w %s", pool), cmdWrapper); err != nil {
+			ui.Message(fmt.Sprintf("Failed to trim ZFS pool %s: %s", pool, strings.TrimSpace(err.Error())))
+		}
+	}
+
+	syscall.Sync()
+
+	after, err := allocatedSize(imagePath)
+	if err != nil {
+		err := fmt.Errorf("Error checking image size: %s", err)
+		return halt(state, err)
+	}
+
+	ui.Message(fmt.Sprintf("Image size: %s -> %s", formatSize(before), formatSize(after)))
+
+	return multistep.ActionContinue
+}
+
+func (s *StepSparsifyImage) Cleanup(state multistep.StateBag) {}
+
+// allocatedSize returns the size of the blocks allocated for the file.
+func allocatedSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512, nil
+	}
+
+	return fi.Size(), nil
+}
+
+func formatSize(size int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(size)/(1024*1024))
+}
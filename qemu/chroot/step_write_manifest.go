@@ -0,0 +1,102 @@
+package chroot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepWriteManifest collects the metadata of the resulting images and
+// writes it to manifest.json in the output directory.
+type StepWriteManifest struct{}
+
+func (s *StepWriteManifest) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	imagePath := state.Get("image_path").(string)
+	outputPaths := state.Get("output_paths").([]string)
+	cmdWrapper := state.Get("command_wrapper").(CommandWrapper)
+
+	ui.Say("Writing manifest...")
+
+	manifest := &Manifest{
+		BuilderID:  BuilderId,
+		BuildName:  config.PackerBuildName,
+		Images:     []ImageMetadata{},
+		Partitions: state.Get("partitions").([]partitionInfo),
+		StartedAt:  state.Get("started_at").(time.Time),
+	}
+
+	if !config.FromScratch {
+		manifest.SourceImage = config.SourceImage
+		manifest.SourceChecksum = config.SourceChecksum
+		manifest.SourceChecksumType = config.SourceChecksumType
+
+		if config.SourceChecksumType == "none" {
+			sourcePath := state.Get("source_image_path").(string)
+			log.Printf("Calculating checksum of source image: %s", sourcePath)
+
+			checksum, _, err := fileChecksums(sourcePath)
+			if err != nil {
+				err := fmt.Errorf("Error calculating checksum of source image: %s", err)
+				return halt(state, err)
+			}
+
+			manifest.SourceChecksum = checksum
+			manifest.SourceChecksumType = "sha256"
+		}
+	}
+
+	for _, path := range append([]string{imagePath}, outputPaths...) {
+		log.Printf("Inspecting image: %s", path)
+
+		info, err := inspectImage(path, cmdWrapper)
+		if err != nil {
+			err := fmt.Errorf("Error inspecting image: %s", err)
+			return halt(state, err)
+		}
+
+		sha256sum, sha512sum, err := fileChecksums(path)
+		if err != nil {
+			err := fmt.Errorf("Error calculating checksum of image: %s", err)
+			return halt(state, err)
+		}
+
+		manifest.Images = append(manifest.Images, ImageMetadata{
+			Path:        filepath.Base(path),
+			Format:      info.Format,
+			VirtualSize: info.VirtualSize,
+			Size:        info.ActualSize,
+			SHA256:      sha256sum,
+			SHA512:      sha512sum,
+		})
+	}
+
+	manifest.FinishedAt = time.Now().UTC()
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		err := fmt.Errorf("Error encoding manifest: %s", err)
+		return halt(state, err)
+	}
+
+	manifestPath := filepath.Join(config.OutputDir, manifestName)
+	if err := ioutil.WriteFile(manifestPath, b, 0644); err != nil {
+		err := fmt.Errorf("Error writing manifest: %s", err)
+		return halt(state, err)
+	}
+
+	state.Put("manifest", manifest)
+	state.Put("manifest_path", manifestPath)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepWriteManifest) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,125 @@
+package chroot
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type zfsDataset struct {
+	Name       string
+	CanMount   string
+	Mountpoint string
+}
+
+// importZFSPool imports the pool on the device with the altroot under a
+// temporary name, which avoids a collision with the pools of the host, and
+// mounts its datasets. It returns the temporary name of the pool.
+func importZFSPool(pool, rootDataset, device, mountPath string, cmdWrapper CommandWrapper) (string, error) {
+	tmpPool := fmt.Sprintf("packer-%s", filepath.Base(device))
+
+	cmd := fmt.Sprintf("zpool import -N -R %s -d %s -t %s %s", mountPath, device, pool, tmpPool)
+	if _, err := runZFSCommand(cmd, cmdWrapper); err != nil {
+		return "", fmt.Errorf("Error importing pool: %s", err)
+	}
+
+	datasets, err := listZFSDatasets(tmpPool, cmdWrapper)
+	if err != nil {
+		return tmpPool, fmt.Errorf("Error listing datasets: %s", err)
+	}
+
+	// The root dataset is usually not mounted automatically.
+	root := ""
+	if rootDataset != "" {
+		root = tmpPool + strings.TrimPrefix(rootDataset, pool)
+	} else {
+		for _, d := range datasets {
+			if d.Mountpoint == mountPath && d.CanMount != "off" {
+				root = d.Name
+				break
+			}
+		}
+	}
+
+	if root == "" {
+		return tmpPool, fmt.Errorf("Root dataset not found in pool: %s", pool)
+	}
+
+	log.Printf("Root dataset: %s", root)
+	if _, err := runZFSCommand(fmt.Sprintf("zfs mount %s", root), cmdWrapper); err != nil {
+		return tmpPool, fmt.Errorf("Error mounting root dataset: %s", err)
+	}
+
+	// Mount other datasets in order of their mountpoint so that parent
+	// directories are mounted first.
+	sort.Slice(datasets, func(i, j int) bool {
+		return datasets[i].Mountpoint < datasets[j].Mountpoint
+	})
+
+	for _, d := range datasets {
+		if d.Name == root || d.CanMount != "on" || !strings.HasPrefix(d.Mountpoint, mountPath+"/") {
+			continue
+		}
+
+		if _, err := runZFSCommand(fmt.Sprintf("zfs mount %s", d.Name), cmdWrapper); err != nil {
+			return tmpPool, fmt.Errorf("Error mounting dataset: %s", err)
+		}
+	}
+
+	return tmpPool, nil
+}
+
+// exportZFSPool unmounts the datasets of the pool and exports it.
+func exportZFSPool(pool string, cmdWrapper CommandWrapper) error {
+	if _, err := runZFSCommand(fmt.Sprintf("zpool export %s", pool), cmdWrapper); err != nil {
+		return fmt.Errorf("Error exporting pool: %s", err)
+	}
+
+	return nil
+}
+
+func listZFSDatasets(pool string, cmdWrapper CommandWrapper) ([]zfsDataset, error) {
+	output, err := runZFSCommand(fmt.Sprintf("zfs list -H -t filesystem -o name,canmount,mountpoint -r %s", pool), cmdWrapper)
+	if err != nil {
+		return nil, err
+	}
+
+	datasets := []zfsDataset{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+
+		datasets = append(datasets, zfsDataset{
+			Name:       fields[0],
+			CanMount:   fields[1],
+			Mountpoint: fields[2],
+		})
+	}
+
+	return datasets, nil
+}
+
+func runZFSCommand(command string, cmdWrapper CommandWrapper) (string, error) {
+	cmd, err := cmdWrapper(command)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("ZFS command: %s", cmd)
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	shell := NewShellCommand(cmd)
+	shell.Stdout = stdout
+	shell.Stderr = stderr
+	if err := shell.Run(); err != nil {
+		return "", fmt.Errorf("%s\n%s", err, stderr)
+	}
+
+	return stdout.String(), nil
+}